@@ -0,0 +1,239 @@
+package util
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Address is a parsed email address.
+type Address struct {
+	// Name is the display name, if any.
+	Name string
+	// Local is the part before the @.
+	Local string
+	// Domain is lower-cased and in its ASCII (punycode) form.
+	Domain string
+	// UnicodeDomain is Domain in its Unicode form.
+	UnicodeDomain string
+}
+
+// Addr returns the bare address, local@domain, with the ASCII domain. A
+// local part which is not a dot-atom, e.g. one with spaces, is quoted.
+func (a *Address) Addr() string {
+	if isDotAtom(a.Local) {
+		return a.Local + "@" + a.Domain
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(a.Local) + `"@` + a.Domain
+}
+
+// String formats the address for use in a header.
+func (a *Address) String() string {
+	// mail.Address quotes the local part itself.
+	return (&mail.Address{Name: a.Name, Address: a.Local + "@" + a.Domain}).String()
+}
+
+// isDotAtom reports whether s is a dot-atom of RFC 5322, allowing UTF-8 as
+// RFC 6532 does.
+func isDotAtom(s string) bool {
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' || strings.Contains(s, "..") {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r > 0x7f:
+		case strings.ContainsRune("!#$%&'*+-/=?^_`{|}~.", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// AddressReason tells why an address was rejected.
+type AddressReason string
+
+const (
+	ReasonSyntax         AddressReason = "syntax"
+	ReasonDisplayName    AddressReason = "display name not allowed"
+	ReasonInvalidDomain  AddressReason = "invalid domain"
+	ReasonNoTLD          AddressReason = "domain has no top-level domain"
+	ReasonLocalTooLong   AddressReason = "local part too long"
+	ReasonDomainTooLong  AddressReason = "domain too long"
+	ReasonAddressTooLong AddressReason = "address too long"
+	ReasonDisposable     AddressReason = "disposable domain"
+	ReasonRoleAccount    AddressReason = "role account"
+)
+
+// AddressError is returned by ParseAddress for rejected addresses.
+type AddressError struct {
+	Address string
+	Reason  AddressReason
+	// Err is the underlying parser error, if any.
+	Err error
+}
+
+func (e *AddressError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("invalid email address %q: %s: %v", e.Address, e.Reason, e.Err)
+	}
+	return fmt.Sprintf("invalid email address %q: %s", e.Address, e.Reason)
+}
+
+func (e *AddressError) Unwrap() error {
+	return e.Err
+}
+
+// Length limits from RFC 5321 section 4.5.3.1.
+const (
+	MaxEmailLocalLength   = 64
+	MaxEmailDomainLength  = 255
+	MaxEmailAddressLength = 254
+)
+
+// AddressOptions enables optional checks in ParseAddress.
+type AddressOptions struct {
+	// BareOnly rejects "Name <addr>" forms.
+	BareOnly bool
+	// RequireTLD rejects single-label domains such as "localhost".
+	RequireTLD bool
+	// CheckLength enforces the RFC 5321 length limits.
+	CheckLength bool
+	// RejectDisposable rejects DisposableDomains, or DefaultDisposableDomains
+	// if nil. Subdomains of a listed domain are rejected as well.
+	RejectDisposable  bool
+	DisposableDomains map[string]bool
+	// RejectRoleAccounts rejects RoleAccounts, or DefaultRoleAccounts if nil.
+	// A "+tag" suffix of the local part is ignored.
+	RejectRoleAccounts bool
+	RoleAccounts       map[string]bool
+}
+
+// DefaultDisposableDomains is a short list of well-known throwaway mail services.
+var DefaultDisposableDomains = map[string]bool{
+	"10minutemail.com":  true,
+	"discard.email":     true,
+	"dispostable.com":   true,
+	"fakeinbox.com":     true,
+	"getnada.com":       true,
+	"guerrillamail.com": true,
+	"mailcatch.com":     true,
+	"maildrop.cc":       true,
+	"mailinator.com":    true,
+	"mailnesia.com":     true,
+	"mintemail.com":     true,
+	"sharklasers.com":   true,
+	"temp-mail.org":     true,
+	"tempmail.com":      true,
+	"throwawaymail.com": true,
+	"trashmail.com":     true,
+	"yopmail.com":       true,
+}
+
+// DefaultRoleAccounts are mailbox names that address a function rather than
+// a person, see RFC 2142.
+var DefaultRoleAccounts = map[string]bool{
+	"abuse":         true,
+	"admin":         true,
+	"administrator": true,
+	"billing":       true,
+	"contact":       true,
+	"help":          true,
+	"hostmaster":    true,
+	"info":          true,
+	"marketing":     true,
+	"noc":           true,
+	"no-reply":      true,
+	"noreply":       true,
+	"postmaster":    true,
+	"root":          true,
+	"sales":         true,
+	"security":      true,
+	"support":       true,
+	"webmaster":     true,
+}
+
+// ParseAddress parses an RFC 5322 address, either bare or with a display
+// name, and normalizes its domain. o may be nil. Rejections are returned as
+// *AddressError.
+func ParseAddress(s string, o *AddressOptions) (*Address, error) {
+	if o == nil {
+		o = &AddressOptions{}
+	}
+	fail := func(reason AddressReason, err error) (*Address, error) {
+		return nil, &AddressError{Address: s, Reason: reason, Err: err}
+	}
+
+	parsed, err := mail.ParseAddress(s)
+	if err != nil {
+		return fail(ReasonSyntax, err)
+	}
+	if o.BareOnly && (parsed.Name != "" || strings.HasSuffix(strings.TrimSpace(s), ">")) {
+		return fail(ReasonDisplayName, nil)
+	}
+
+	at := strings.LastIndex(parsed.Address, "@")
+	a := &Address{Name: parsed.Name, Local: parsed.Address[:at]}
+	domain := parsed.Address[at+1:]
+
+	if strings.HasPrefix(domain, "[") {
+		// Domain literals like [192.0.2.1] are kept as they are.
+		a.Domain, a.UnicodeDomain = domain, domain
+	} else {
+		ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(domain, "."))
+		if err != nil || ascii == "" {
+			return fail(ReasonInvalidDomain, err)
+		}
+		a.Domain = strings.ToLower(ascii)
+		a.UnicodeDomain, _ = idna.Display.ToUnicode(a.Domain)
+		if o.RequireTLD && !strings.Contains(a.Domain, ".") {
+			return fail(ReasonNoTLD, nil)
+		}
+	}
+
+	if o.CheckLength {
+		switch {
+		case len(a.Local) > MaxEmailLocalLength:
+			return fail(ReasonLocalTooLong, nil)
+		case len(a.Domain) > MaxEmailDomainLength:
+			return fail(ReasonDomainTooLong, nil)
+		case len(a.Addr()) > MaxEmailAddressLength:
+			return fail(ReasonAddressTooLong, nil)
+		}
+	}
+
+	if o.RejectDisposable {
+		list := o.DisposableDomains
+		if list == nil {
+			list = DefaultDisposableDomains
+		}
+		for d := a.Domain; d != ""; {
+			if list[d] {
+				return fail(ReasonDisposable, nil)
+			}
+			i := strings.Index(d, ".")
+			if i < 0 {
+				break
+			}
+			d = d[i+1:]
+		}
+	}
+
+	if o.RejectRoleAccounts {
+		list := o.RoleAccounts
+		if list == nil {
+			list = DefaultRoleAccounts
+		}
+		local := strings.ToLower(a.Local)
+		if i := strings.Index(local, "+"); i >= 0 {
+			local = local[:i]
+		}
+		if list[local] {
+			return fail(ReasonRoleAccount, nil)
+		}
+	}
+
+	return a, nil
+}
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"net/mail"
+	"testing"
+)
+
+func TestAddressAddrQuotesLocalPart(t *testing.T) {
+	for _, c := range []struct{ in, addr string }{
+		{"john@example.com", "john@example.com"},
+		{"john.q+tag@Example.COM", "john.q+tag@example.com"},
+		{`"john doe"@example.com`, `"john doe"@example.com`},
+		{`"john..doe"@example.com`, `"john..doe"@example.com`},
+		{`"a\"b"@example.com`, `"a\"b"@example.com`},
+		{"John <john@bücher.example>", "john@xn--bcher-kva.example"},
+	} {
+		a, err := ParseAddress(c.in, nil)
+		if err != nil {
+			t.Errorf("%s: %v", c.in, err)
+			continue
+		}
+		if got := a.Addr(); got != c.addr {
+			t.Errorf("%s: Addr() = %s, want %s", c.in, got, c.addr)
+		}
+		// The result must parse back to the same address.
+		back, err := mail.ParseAddress(a.String())
+		if err != nil {
+			t.Errorf("%s: String() = %s: %v", c.in, a.String(), err)
+		} else if back.Address != a.Local+"@"+a.Domain {
+			t.Errorf("%s: String() parses to %s", c.in, back.Address)
+		}
+	}
+}
+
+func TestIsValidEmail(t *testing.T) {
+	for s, want := range map[string]bool{
+		"john@example.com":        true,
+		"john@sub.example.com":    true,
+		`"john doe"@example.com`:  true,
+		"john@localhost":          false,
+		"John <john@example.com>": false,
+		"john@ex_ample.com":       false,
+		"john@":                   false,
+	} {
+		if got := IsValidEmail(s); got != want {
+			t.Errorf("IsValidEmail(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
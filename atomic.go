@@ -0,0 +1,135 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// FileOption configures how Store, Load, StoreJson, StoreGob and
+// WriteFileAtomic handle files.
+type FileOption func(*fileOptions)
+
+type fileOptions struct {
+	backups     int
+	codec       string
+	compression Compression
+	cipher      Cipher
+	keys        KeyProvider
+	plaintext   bool
+	schema      string
+	rewrite     bool
+
+	disallowUnknownFields bool
+	useNumber             bool
+	maxSize               int64
+	jsonSchema            *JsonSchema
+}
+
+func newFileOptions(opts []FileOption) *fileOptions {
+	o := &fileOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithBackups keeps the n previous versions of a file as "name.1" (the most
+// recent) to "name.n".
+func WithBackups(n int) FileOption {
+	return func(o *fileOptions) {
+		o.backups = n
+	}
+}
+
+// WriteFileAtomic writes data to a temporary file in the directory of
+// filename, syncs it and renames it over filename, so that readers and a crash
+// see either the old or the new content, never a part of it.
+func WriteFileAtomic(filename string, data []byte, fileMode os.FileMode, opts ...FileOption) (err error) {
+	if err = writeFileAtomic(filename, data, fileMode, newFileOptions(opts)); err != nil {
+		return opError("WriteFileAtomic", filename, ErrWrite, err)
+	}
+	return
+}
+
+func writeFileAtomic(filename string, data []byte, fileMode os.FileMode, o *fileOptions) (err error) {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := os.CreateTemp(dir, "."+base+".tmp*")
+	if err != nil {
+		return
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	if err = f.Chmod(fileMode); err != nil {
+		return
+	}
+	if _, err = f.Write(data); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+
+	if o.backups > 0 {
+		if err = rotateBackups(filename, o.backups); err != nil {
+			return
+		}
+	}
+	if err = os.Rename(tmp, filename); err != nil {
+		return
+	}
+	return syncDir(dir)
+}
+
+// rotateBackups shifts name.1..name.n-1 up by one and links the current
+// file as name.1, leaving name itself in place until it is replaced.
+func rotateBackups(filename string, n int) error {
+	if _, err := os.Lstat(filename); os.IsNotExist(err) {
+		return nil
+	}
+	backup := func(i int) string {
+		return fmt.Sprintf("%s.%d", filename, i)
+	}
+
+	if err := os.Remove(backup(n)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := n - 1; i >= 1; i-- {
+		if err := os.Rename(backup(i), backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Link(filename, backup(1)); err != nil {
+		// Hard links are not supported everywhere.
+		return CopyFile(filename, backup(1))
+	}
+	return nil
+}
+
+// syncDir makes a rename in dir durable. Directories cannot be synced on
+// Windows, where renames are durable on their own.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
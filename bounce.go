@@ -0,0 +1,251 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// ErrNotBounce is returned by ParseBounce for messages which are not
+// delivery notifications.
+var ErrNotBounce = errors.New("not a bounce message")
+
+// Bounce formats recognized by ParseBounce.
+const (
+	BounceDSN   = "dsn"
+	BounceExim  = "exim"
+	BounceQmail = "qmail"
+	BounceText  = "text"
+)
+
+// Bounce is a parsed delivery status notification.
+type Bounce struct {
+	// Format is one of the Bounce* constants.
+	Format       string
+	ReportingMTA string
+	// OriginalMessageID is the Message-ID of the bounced message, if the
+	// notification includes its headers.
+	OriginalMessageID string
+	Recipients        []BounceRecipient
+}
+
+// BounceRecipient is the delivery status of a single recipient.
+type BounceRecipient struct {
+	OriginalRecipient string
+	FinalRecipient    string
+	// Action is failed, delayed, delivered, relayed or expanded.
+	Action string
+	// Status is the RFC 3463 enhanced status code, e.g. "5.1.1".
+	Status     string
+	Diagnostic string
+	RemoteMTA  string
+}
+
+// Address returns the original recipient, falling back to the final one.
+func (r *BounceRecipient) Address() string {
+	if r.OriginalRecipient != "" {
+		return r.OriginalRecipient
+	}
+	return r.FinalRecipient
+}
+
+// Permanent reports whether delivery failed for good, i.e. the address should
+// be marked as undeliverable.
+func (r *BounceRecipient) Permanent() bool {
+	return r.Action == "failed" && strings.HasPrefix(r.Status, "5")
+}
+
+var (
+	bounceSubject    = regexp.MustCompile(`(?i)undeliver|delivery (status notification|failure|has failed)|mail delivery failed|returned mail|failure notice|delivery problem|non[- ]?delivery`)
+	bounceSender     = regexp.MustCompile(`(?i)mailer-daemon|postmaster`)
+	bounceRecipient  = regexp.MustCompile(`^\s*<([^<>\s]+@[^<>\s]+)>:?\s*(.*)$`)
+	bounceEximRcpt   = regexp.MustCompile(`^\s{2,}([^\s<>]+@[^\s<>]+)\s*$`)
+	enhancedStatus   = regexp.MustCompile(`(?:^|[^\d.])([245]\.\d{1,3}\.\d{1,3})(?:[^\d.]|$)`)
+	basicStatus      = regexp.MustCompile(`\b([245]\d\d)[\s-]`)
+	bounceQmailIntro = regexp.MustCompile(`(?i)this is the qmail-send program`)
+	bounceCopyMarker = regexp.MustCompile(`(?i)^-+\s*(below this line is a copy|this is a copy of the message|original message)`)
+)
+
+// ParseBounce parses an RFC 3464 delivery status notification or one of the
+// common plain text bounce formats (Exim, qmail, Postfix and similar).
+func ParseBounce(r io.Reader) (*Bounce, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	header := textproto.MIMEHeader(msg.Header)
+	parts, err := mimeParts(header, msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bounce{}
+	for _, p := range parts {
+		mediaType, _, _ := mime.ParseMediaType(p.ContentType)
+		switch mediaType {
+		case "message/delivery-status", "message/global-delivery-status":
+			if err := parseDeliveryStatus(b, p.Body); err != nil {
+				return nil, err
+			}
+			b.Format = BounceDSN
+		case "message/rfc822", "text/rfc822-headers", "message/global", "message/global-headers":
+			// Both forms start with the header of the original message.
+			h, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(p.Body))).ReadMIMEHeader()
+			b.OriginalMessageID = h.Get("Message-Id")
+		}
+	}
+	if b.Format == BounceDSN && len(b.Recipients) > 0 {
+		return b, nil
+	}
+
+	if !bounceSubject.MatchString(header.Get("Subject")) &&
+		!bounceSender.MatchString(header.Get("From")) &&
+		header.Get("X-Failed-Recipients") == "" {
+		return nil, ErrNotBounce
+	}
+
+	var text []byte
+	for _, p := range parts {
+		if mediaType, _, _ := mime.ParseMediaType(p.ContentType); mediaType == "text/plain" {
+			text = p.Body
+			break
+		}
+	}
+	parseTextBounce(b, header, string(text))
+	if len(b.Recipients) == 0 {
+		return nil, ErrNotBounce
+	}
+	return b, nil
+}
+
+// parseDeliveryStatus reads the per-message and per-recipient field blocks.
+func parseDeliveryStatus(b *Bounce, body []byte) error {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(body)))
+
+	first := true
+	for {
+		h, err := tp.ReadMIMEHeader()
+		if len(h) > 0 {
+			if first {
+				b.ReportingMTA = dsnValue(h.Get("Reporting-Mta"))
+				first = false
+			} else {
+				b.Recipients = append(b.Recipients, BounceRecipient{
+					OriginalRecipient: dsnValue(h.Get("Original-Recipient")),
+					FinalRecipient:    dsnValue(h.Get("Final-Recipient")),
+					Action:            strings.ToLower(strings.TrimSpace(h.Get("Action"))),
+					Status:            strings.TrimSpace(h.Get("Status")),
+					Diagnostic:        dsnValue(h.Get("Diagnostic-Code")),
+					RemoteMTA:         dsnValue(h.Get("Remote-Mta")),
+				})
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// dsnValue strips the type prefix of typed DSN fields, e.g. "rfc822; a@b".
+func dsnValue(v string) string {
+	if i := strings.Index(v, ";"); i >= 0 {
+		v = v[i+1:]
+	}
+	return strings.TrimSpace(v)
+}
+
+// parseTextBounce extracts recipients and reasons from human readable
+// bounces, stopping at the copy of the original message.
+func parseTextBounce(b *Bounce, header textproto.MIMEHeader, text string) {
+	b.Format = BounceText
+	switch {
+	case header.Get("X-Failed-Recipients") != "":
+		b.Format = BounceExim
+	case bounceQmailIntro.MatchString(text):
+		b.Format = BounceQmail
+	}
+
+	var lines []string
+	for _, l := range strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n") {
+		if bounceCopyMarker.MatchString(l) {
+			break
+		}
+		lines = append(lines, l)
+	}
+
+	index := make(map[string]int)
+	add := func(addr string) *BounceRecipient {
+		key := strings.ToLower(addr)
+		if i, ok := index[key]; ok {
+			return &b.Recipients[i]
+		}
+		index[key] = len(b.Recipients)
+		b.Recipients = append(b.Recipients, BounceRecipient{FinalRecipient: addr})
+		return &b.Recipients[len(b.Recipients)-1]
+	}
+
+	for _, v := range strings.Split(header.Get("X-Failed-Recipients"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			add(v)
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		m := bounceRecipient.FindStringSubmatch(lines[i])
+		if m == nil {
+			m = bounceEximRcpt.FindStringSubmatch(lines[i])
+		}
+		if m == nil {
+			continue
+		}
+		rcpt := add(m[1])
+
+		// The reason follows on the same line and the indented or non-empty
+		// lines below, up to the next blank line.
+		var reason []string
+		if len(m) > 2 && m[2] != "" {
+			reason = append(reason, m[2])
+		}
+		for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" && bounceRecipient.FindStringSubmatch(lines[i+1]) == nil {
+			i++
+			reason = append(reason, strings.TrimSpace(lines[i]))
+		}
+		if rcpt.Diagnostic == "" {
+			rcpt.Diagnostic = strings.Join(reason, " ")
+		}
+	}
+
+	whole := strings.Join(lines, "\n")
+	for i := range b.Recipients {
+		rcpt := &b.Recipients[i]
+		source := rcpt.Diagnostic
+		if source == "" {
+			source = whole
+		}
+		if m := enhancedStatus.FindStringSubmatch(source); m != nil {
+			rcpt.Status = m[1]
+		} else if m := basicStatus.FindStringSubmatch(source + " "); m != nil {
+			rcpt.Status = m[1][:1] + ".0.0"
+		} else {
+			// Text bounces without a code are final by convention.
+			rcpt.Status = "5.0.0"
+		}
+		switch rcpt.Status[0] {
+		case '4':
+			rcpt.Action = "delayed"
+		case '2':
+			rcpt.Action = "delivered"
+		default:
+			rcpt.Action = "failed"
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseBounce(t *testing.T) {
+	type rcpt struct {
+		addr, status, action string
+		permanent            bool
+	}
+	for _, tc := range []struct {
+		file, format, messageID string
+		rcpts                   []rcpt
+	}{
+		{"dsn.eml", BounceDSN, "<orig-1@example.com>", []rcpt{
+			{"Nobody@Example.org", "5.1.1", "failed", true},
+			{"full@example.org", "4.2.2", "delayed", false},
+		}},
+		{"exim.eml", BounceExim, "", []rcpt{
+			{"gone@example.net", "5.1.1", "failed", true},
+		}},
+		{"qmail.eml", BounceQmail, "", []rcpt{
+			{"unknown@qmail.example.com", "5.1.1", "failed", true},
+			{"busy@remote.example", "4.3.0", "delayed", false},
+		}},
+	} {
+		f, err := os.Open(filepath.Join("testdata", "bounce", tc.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ParseBounce(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tc.file, err)
+			continue
+		}
+		if b.Format != tc.format || b.OriginalMessageID != tc.messageID || len(b.Recipients) != len(tc.rcpts) {
+			t.Errorf("%s: got %+v", tc.file, b)
+			continue
+		}
+		for i, want := range tc.rcpts {
+			r := b.Recipients[i]
+			if r.Address() != want.addr || r.Status != want.status || r.Action != want.action || r.Permanent() != want.permanent {
+				t.Errorf("%s: recipient %d = %+v, permanent %v, want %+v", tc.file, i, r, r.Permanent(), want)
+			}
+		}
+	}
+}
+
+func TestParseBounceDSNFields(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "bounce", "dsn.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ParseBounce(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Recipients[0]
+	if b.ReportingMTA != "mx.example.org" || r.RemoteMTA != "in.example.org" || r.FinalRecipient != "nobody@example.org" ||
+		!strings.HasPrefix(r.Diagnostic, "550 5.1.1") || !strings.Contains(r.Diagnostic, "User unknown") {
+		t.Errorf("got %+v", b)
+	}
+}
+
+func TestParseBounceNotBounce(t *testing.T) {
+	msg := "From: friend@example.com\r\nTo: me@example.com\r\nSubject: Lunch\r\n\r\n<a@example.com>: see you\r\n"
+	if _, err := ParseBounce(strings.NewReader(msg)); !errors.Is(err, ErrNotBounce) {
+		t.Errorf("got %v, want ErrNotBounce", err)
+	}
+}
@@ -0,0 +1,188 @@
+package util
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// BulkOptions controls the pace of SendBulk.
+type BulkOptions struct {
+	// Rate limits the number of messages per second, unlimited if zero.
+	Rate float64
+	// DomainRate limits the number of messages per second to each recipient
+	// domain, unlimited if zero.
+	DomainRate float64
+	// Concurrency is the number of messages in flight, 1 if zero.
+	Concurrency int
+	// Progress is called after every attempted message. Calls are serialized.
+	Progress func(BulkProgress)
+}
+
+// BulkProgress reports the state of a SendBulk run.
+type BulkProgress struct {
+	Sent      int
+	Failed    int
+	Remaining int
+	// Recipient and Err describe the message that triggered the report.
+	Recipient string
+	Err       error
+}
+
+// BulkFailure is a recipient which could not be sent to.
+type BulkFailure struct {
+	Recipient string
+	Err       error
+}
+
+// BulkResult summarizes a SendBulk run.
+type BulkResult struct {
+	Sent     int
+	Failures []BulkFailure
+	// Skipped lists, in their original order, the recipients not attempted
+	// because ctx ended the run.
+	Skipped []string
+}
+
+// SendBulk builds a message for every recipient and sends it through t
+// respecting the rate limits in o. Failures of single messages are collected
+// in the result; the returned error is only set when ctx ends the run early,
+// and the recipients not attempted then are listed in BulkResult.Skipped.
+func SendBulk(ctx context.Context, t Transport, recipients []string, build func(to string) (*gomail.Message, error), o BulkOptions) (*BulkResult, error) {
+	workers := o.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	global := newRateLimiter(o.Rate)
+	var domainsMu sync.Mutex
+	domains := make(map[string]*rateLimiter)
+	domainLimiter := func(rcpt string) *rateLimiter {
+		if o.DomainRate <= 0 {
+			return nil
+		}
+		domain := strings.ToLower(rcpt[strings.LastIndex(rcpt, "@")+1:])
+		domainsMu.Lock()
+		defer domainsMu.Unlock()
+		l := domains[domain]
+		if l == nil {
+			l = newRateLimiter(o.DomainRate)
+			domains[domain] = l
+		}
+		return l
+	}
+
+	result := &BulkResult{}
+	var mu sync.Mutex
+	skipped := make([]bool, len(recipients))
+	progress := BulkProgress{Remaining: len(recipients)}
+	report := func(rcpt string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		progress.Remaining--
+		if err != nil {
+			progress.Failed++
+			result.Failures = append(result.Failures, BulkFailure{Recipient: rcpt, Err: err})
+		} else {
+			progress.Sent++
+			result.Sent++
+		}
+		if o.Progress != nil {
+			p := progress
+			p.Recipient, p.Err = rcpt, err
+			o.Progress(p)
+		}
+	}
+
+	skip := func(i int) {
+		mu.Lock()
+		skipped[i] = true
+		mu.Unlock()
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				rcpt := recipients[i]
+				if err := domainLimiter(rcpt).wait(ctx); err != nil {
+					skip(i)
+					continue
+				}
+				if err := global.wait(ctx); err != nil {
+					skip(i)
+					continue
+				}
+				m, err := build(rcpt)
+				if err == nil {
+					err = SendMessage(t, m)
+				}
+				report(rcpt, err)
+			}
+		}()
+	}
+
+	fed := 0
+feed:
+	for ; fed < len(recipients); fed++ {
+		select {
+		case jobs <- fed:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, rcpt := range recipients {
+		if skipped[i] || i >= fed {
+			result.Skipped = append(result.Skipped, rcpt)
+		}
+	}
+	return result, ctx.Err()
+}
+
+// rateLimiter spaces events evenly at a fixed rate. A nil *rateLimiter does
+// not limit.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until the next event is allowed or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(at.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
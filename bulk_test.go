@@ -0,0 +1,169 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// bulkTransport counts messages in flight and fails recipients starting
+// with "fail".
+type bulkTransport struct {
+	delay time.Duration
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+	sent        []string
+}
+
+func (t *bulkTransport) Send(from string, to []string, msg io.WriterTo) error {
+	t.mu.Lock()
+	t.inFlight++
+	if t.inFlight > t.maxInFlight {
+		t.maxInFlight = t.inFlight
+	}
+	t.mu.Unlock()
+
+	time.Sleep(t.delay)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inFlight--
+	if strings.HasPrefix(to[0], "fail") {
+		return errors.New("rejected")
+	}
+	t.sent = append(t.sent, to[0])
+	return nil
+}
+
+func bulkMessage(to string) (*gomail.Message, error) {
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", to)
+	m.SetHeader("Subject", "Hello")
+	m.SetBody("text/plain", "body")
+	return m, nil
+}
+
+func bulkRecipients(n int, domains ...string) []string {
+	rcpts := make([]string, n)
+	for i := range rcpts {
+		rcpts[i] = fmt.Sprintf("user%d@%s", i, domains[i%len(domains)])
+	}
+	return rcpts
+}
+
+func TestSendBulkFailuresAndProgress(t *testing.T) {
+	tr := &bulkTransport{}
+	rcpts := append(bulkRecipients(8, "example.com"), "fail1@example.com", "fail2@example.org")
+	var reports []BulkProgress
+	build := func(to string) (*gomail.Message, error) {
+		if to == "user3@example.com" {
+			return nil, errors.New("no template")
+		}
+		return bulkMessage(to)
+	}
+	res, err := SendBulk(context.Background(), tr, rcpts, build, BulkOptions{
+		Concurrency: 3,
+		Progress:    func(p BulkProgress) { reports = append(reports, p) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Sent != 7 || len(res.Failures) != 3 || len(res.Skipped) != 0 {
+		t.Fatalf("got %+v", res)
+	}
+	failed := map[string]bool{}
+	for _, f := range res.Failures {
+		failed[f.Recipient] = f.Err != nil
+	}
+	for _, r := range []string{"user3@example.com", "fail1@example.com", "fail2@example.org"} {
+		if !failed[r] {
+			t.Errorf("%s not reported: %+v", r, res.Failures)
+		}
+	}
+
+	if len(reports) != len(rcpts) {
+		t.Fatalf("%d progress reports", len(reports))
+	}
+	for i, p := range reports {
+		if p.Sent+p.Failed != i+1 || p.Remaining != len(rcpts)-i-1 || (p.Err != nil) != failed[p.Recipient] {
+			t.Errorf("report %d: %+v", i, p)
+		}
+	}
+	if last := reports[len(reports)-1]; last.Sent != 7 || last.Failed != 3 {
+		t.Errorf("last report %+v", last)
+	}
+}
+
+func TestSendBulkConcurrency(t *testing.T) {
+	for _, n := range []int{0, 1, 4} {
+		tr := &bulkTransport{delay: 5 * time.Millisecond}
+		if _, err := SendBulk(context.Background(), tr, bulkRecipients(20, "example.com"), bulkMessage, BulkOptions{Concurrency: n}); err != nil {
+			t.Fatal(err)
+		}
+		want := n
+		if want == 0 {
+			want = 1
+		}
+		if tr.maxInFlight > want || len(tr.sent) != 20 {
+			t.Errorf("concurrency %d: %d in flight, %d sent", n, tr.maxInFlight, len(tr.sent))
+		}
+		if n == 4 && tr.maxInFlight < 2 {
+			t.Errorf("concurrency %d: never more than one in flight", n)
+		}
+	}
+}
+
+func TestSendBulkRate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		o    BulkOptions
+		// min is the least time 10 messages to two domains can take.
+		min time.Duration
+	}{
+		{"global", BulkOptions{Rate: 100, Concurrency: 4}, 90 * time.Millisecond},
+		{"domain", BulkOptions{DomainRate: 50, Concurrency: 4}, 80 * time.Millisecond},
+	} {
+		start := time.Now()
+		tr := &bulkTransport{}
+		if _, err := SendBulk(context.Background(), tr, bulkRecipients(10, "a.example", "b.example"), bulkMessage, tc.o); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d < tc.min || len(tr.sent) != 10 {
+			t.Errorf("%s: %d sent in %v, want at least %v", tc.name, len(tr.sent), d, tc.min)
+		}
+	}
+}
+
+func TestSendBulkCancelReportsSkipped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rcpts := bulkRecipients(20, "example.com")
+	var sent int
+	res, err := SendBulk(ctx, &bulkTransport{}, rcpts, bulkMessage, BulkOptions{
+		Rate: 1000,
+		Progress: func(p BulkProgress) {
+			if sent = p.Sent; sent == 5 {
+				cancel()
+			}
+		},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v", err)
+	}
+	if res.Sent+len(res.Failures)+len(res.Skipped) != len(rcpts) || len(res.Skipped) == 0 {
+		t.Fatalf("sent %d, failed %d, skipped %d", res.Sent, len(res.Failures), len(res.Skipped))
+	}
+	if want := rcpts[len(rcpts)-len(res.Skipped):]; strings.Join(res.Skipped, ",") != strings.Join(want, ",") {
+		t.Errorf("skipped %v, want %v", res.Skipped, want)
+	}
+}
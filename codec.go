@@ -0,0 +1,174 @@
+package util
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Codec encodes and decodes values in one file format. Codecs for YAML, TOML
+// and MessagePack are registered by importing
+// github.com/ekzeb/gutils/codecs.
+type Codec interface {
+	// Name identifies the codec for WithCodec, e.g. "json".
+	Name() string
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+var (
+	codecsMu     sync.RWMutex
+	codecsByName = make(map[string]Codec)
+	codecsByExt  = make(map[string]Codec)
+)
+
+func init() {
+	RegisterCodec(jsonCodec{}, ".json")
+	RegisterCodec(gobCodec{}, ".gob")
+}
+
+// RegisterCodec makes c available to Store and Load by name and for files
+// with the given extensions, e.g. ".yaml". A later registration replaces an
+// earlier one of the same name or extension.
+func RegisterCodec(c Codec, extensions ...string) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecsByName[c.Name()] = c
+	for _, ext := range extensions {
+		codecsByExt[strings.ToLower(ext)] = c
+	}
+}
+
+// Codecs returns the names of the registered codecs, sorted.
+func Codecs() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	var names []string
+	for name := range codecsByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithCodec makes Store and Load use the named codec whatever the file
+// extension.
+func WithCodec(name string) FileOption {
+	return func(o *fileOptions) {
+		o.codec = name
+	}
+}
+
+// codecFor returns the codec chosen by the options or the file extension.
+func codecFor(filename string, o *fileOptions) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	if o.codec != "" {
+		c, ok := codecsByName[o.codec]
+		return c, ok
+	}
+	c, ok := codecsByExt[strings.ToLower(filepath.Ext(filename))]
+	return c, ok
+}
+
+// Store encodes data with the codec for filename and writes it atomically,
+// see WriteFileAtomic.
+func Store(data interface{}, filename string, fileMode os.FileMode, opts ...FileOption) (err error) {
+	o := newFileOptions(opts)
+	c, ok := codecFor(filename, o)
+	if !ok {
+		return opError("Store", filename, ErrUnknownCodec, nil)
+	}
+	return store("Store", c, data, filename, fileMode, o)
+}
+
+// Load decodes filename into data with the codec for filename. Files whose
+// header names another codec fail with ErrUnknownCodec.
+func Load(data interface{}, filename string, opts ...FileOption) (err error) {
+	o := newFileOptions(opts)
+	c, ok := codecFor(filename, o)
+	if !ok {
+		return opError("Load", filename, ErrUnknownCodec, nil)
+	}
+	return load("Load", c, data, filename, o)
+}
+
+func store(op string, c Codec, data interface{}, filename string, fileMode os.FileMode, o *fileOptions) (err error) {
+	b, err := encodeFile(c, data, o)
+	if err != nil {
+		return opError(op, filename, ErrEncode, err)
+	}
+	if err = writeFileAtomic(filename, b, fileMode, o); err != nil {
+		return opError(op, filename, ErrWrite, err)
+	}
+	return
+}
+
+func load(op string, c Codec, data interface{}, filename string, o *fileOptions) (err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return opError(op, filename, ErrRead, err)
+	}
+	h, upgraded, err := decodeFile(c, f, data, o)
+	f.Close()
+	if err != nil {
+		return opError(op, filename, ErrDecode, err)
+	}
+	if upgraded && o.rewrite {
+		return rewriteUpgraded(op, c, data, filename, h, o)
+	}
+	return
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Decode fails with ErrTrailingData when anything but whitespace follows the
+// value, as json.Unmarshal does.
+func (jsonCodec) Decode(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return ErrTrailingData
+	}
+	return nil
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Encode(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+func (gobCodec) Decode(r io.Reader, v interface{}) error {
+	return gob.NewDecoder(r).Decode(v)
+}
+
+// strictJsonCodec decodes with the JSON options of LoadJson.
+type strictJsonCodec struct {
+	o *fileOptions
+}
+
+func (strictJsonCodec) Name() string { return "json" }
+
+func (strictJsonCodec) Encode(w io.Writer, v interface{}) error {
+	return jsonCodec{}.Encode(w, v)
+}
+
+func (c strictJsonCodec) Decode(r io.Reader, v interface{}) error {
+	return decodeJson(r, v, c.o)
+}
@@ -0,0 +1,91 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type codecTestValue struct {
+	Name  string
+	Count int
+	Tags  []string
+	Attrs map[string]string
+}
+
+var codecTestData = codecTestValue{Name: "x", Count: 3, Tags: []string{"a", "b"}, Attrs: map[string]string{"k": "v"}}
+
+func TestStoreLoadByExtension(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"v.json", "v.gob", "v.JSON"} {
+		filename := filepath.Join(dir, name)
+		if err := Store(codecTestData, filename, 0600); err != nil {
+			t.Fatal(err)
+		}
+		var v codecTestValue
+		if err := Load(&v, filename); err != nil || !reflect.DeepEqual(v, codecTestData) {
+			t.Errorf("%s: got %+v, %v", name, v, err)
+		}
+	}
+
+	filename := filepath.Join(dir, "v.conf")
+	if err := Store(codecTestData, filename, 0600); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("unknown extension: %v", err)
+	}
+	if err := Store(codecTestData, filename, 0600, WithCodec("gob")); err != nil {
+		t.Fatal(err)
+	}
+	var v codecTestValue
+	if err := Load(&v, filename, WithCodec("gob")); err != nil || !reflect.DeepEqual(v, codecTestData) {
+		t.Errorf("by name: got %+v, %v", v, err)
+	}
+	if err := Load(&v, filename, WithCodec("nope")); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("unknown name: %v", err)
+	}
+}
+
+// upperCodec stores strings upper-cased, to tell it from the codec it
+// replaces.
+type upperCodec struct{ upper bool }
+
+func (upperCodec) Name() string { return "test-dup" }
+
+func (c upperCodec) Encode(w io.Writer, v interface{}) error {
+	s := *v.(*string)
+	if c.upper {
+		s = strings.ToUpper(s)
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func (upperCodec) Decode(r io.Reader, v interface{}) error {
+	b, err := io.ReadAll(r)
+	*v.(*string) = string(b)
+	return err
+}
+
+func TestRegisterCodecReplaces(t *testing.T) {
+	RegisterCodec(upperCodec{}, ".tdup")
+	RegisterCodec(upperCodec{upper: true}, ".TDUP2", ".tdup")
+
+	names := strings.Join(Codecs(), ",")
+	if strings.Count(names, "test-dup") != 1 || !strings.Contains(names, "json") || !strings.Contains(names, "gob") {
+		t.Errorf("Codecs() = %s", names)
+	}
+	dir := t.TempDir()
+	for _, name := range []string{"v.tdup", "v.tdup2"} {
+		s := "hello"
+		filename := filepath.Join(dir, name)
+		if err := Store(&s, filename, 0600); err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if err := Load(&got, filename); err != nil || got != "HELLO" {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Package codecs registers YAML, TOML and MessagePack codecs with util.Store
+// and util.Load. Import it for its side effect:
+//
+//	import _ "github.com/ekzeb/gutils/codecs"
+//
+//	err := util.Store(config, "config.yaml", util.DefaultFileMode)
+package codecs
+
+import (
+	"io"
+
+	"github.com/BurntSushi/toml"
+	util "github.com/ekzeb/gutils"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	util.RegisterCodec(YAML{}, ".yaml", ".yml")
+	util.RegisterCodec(TOML{}, ".toml")
+	util.RegisterCodec(MsgPack{}, ".msgpack", ".mpk")
+}
+
+// YAML encodes YAML 1.2 documents.
+type YAML struct{}
+
+func (YAML) Name() string { return "yaml" }
+
+func (YAML) Encode(w io.Writer, v interface{}) error {
+	enc := yaml.NewEncoder(w)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func (YAML) Decode(r io.Reader, v interface{}) error {
+	return yaml.NewDecoder(r).Decode(v)
+}
+
+// TOML encodes TOML documents. Only maps and structs can be encoded.
+type TOML struct{}
+
+func (TOML) Name() string { return "toml" }
+
+func (TOML) Encode(w io.Writer, v interface{}) error {
+	return toml.NewEncoder(w).Encode(v)
+}
+
+func (TOML) Decode(r io.Reader, v interface{}) error {
+	_, err := toml.NewDecoder(r).Decode(v)
+	return err
+}
+
+// MsgPack encodes MessagePack.
+type MsgPack struct{}
+
+func (MsgPack) Name() string { return "msgpack" }
+
+func (MsgPack) Encode(w io.Writer, v interface{}) error {
+	return msgpack.NewEncoder(w).Encode(v)
+}
+
+func (MsgPack) Decode(r io.Reader, v interface{}) error {
+	return msgpack.NewDecoder(r).Decode(v)
+}
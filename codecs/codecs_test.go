@@ -0,0 +1,50 @@
+package codecs_test
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	util "github.com/ekzeb/gutils"
+	_ "github.com/ekzeb/gutils/codecs"
+)
+
+type config struct {
+	Name  string            `yaml:"name" toml:"name" msgpack:"name"`
+	Port  int               `yaml:"port" toml:"port" msgpack:"port"`
+	Hosts []string          `yaml:"hosts" toml:"hosts" msgpack:"hosts"`
+	Env   map[string]string `yaml:"env" toml:"env" msgpack:"env"`
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	want := config{Name: "x", Port: 8080, Hosts: []string{"a", "b"}, Env: map[string]string{"K": "v"}}
+	dir := t.TempDir()
+	for _, name := range []string{"c.yaml", "c.yml", "c.toml", "c.msgpack", "c.mpk"} {
+		filename := filepath.Join(dir, name)
+		if err := util.Store(want, filename, 0600); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var got config
+		if err := util.Load(&got, filename); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, %v", name, got, err)
+		}
+	}
+
+	filename := filepath.Join(dir, "c.conf")
+	for _, codec := range []string{"yaml", "toml", "msgpack"} {
+		if err := util.Store(want, filename, 0600, util.WithCodec(codec)); err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		var got config
+		if err := util.Load(&got, filename, util.WithCodec(codec)); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, %v", codec, got, err)
+		}
+	}
+}
+
+func TestCodecsRegistered(t *testing.T) {
+	if got := strings.Join(util.Codecs(), ","); got != "gob,json,msgpack,toml,yaml" {
+		t.Errorf("Codecs() = %s", got)
+	}
+}
@@ -1,96 +1,91 @@
 package util
 
 import (
-	"compress/gzip"
 	"archive/tar"
-	"strings"
-	"os"
-	"log"
+	"compress/gzip"
 	"io"
+	"os"
+	"path"
+	"strings"
 )
 
-func tarGzWrite( _path string, tw *tar.Writer, fi os.FileInfo) (err error) {
-	fr, er := os.Open( _path )
-
-	if er != nil {
-		err = er
-		log.Println("TarGz Error", err)
-		return
+func tarGzWrite(_path string, tw *tar.Writer, fi os.FileInfo) (err error) {
+	fr, err := os.Open(_path)
+	if err != nil {
+		return opError("TarGz", _path, ErrRead, err)
 	}
-
 	defer fr.Close()
 
-	h := new( tar.Header )
+	h := new(tar.Header)
 	h.Name = strings.Replace(_path, "dest/", "", 1)
 
 	h.Size = fi.Size()
-	h.Mode = int64( fi.Mode() )
+	h.Mode = int64(fi.Mode())
 	h.ModTime = fi.ModTime()
 
-	err = tw.WriteHeader( h )
-	if err != nil {
-		log.Println("TarGz Error", err)
-		return
+	if err = tw.WriteHeader(h); err != nil {
+		return opError("TarGz", _path, ErrWrite, err)
 	}
 
-	_, err = io.Copy( tw, fr )
-	if err != nil {
-		log.Println("TarGz Error", err)
-		return
+	if _, err = io.Copy(tw, fr); err != nil {
+		return opError("TarGz", _path, ErrWrite, err)
 	}
 	return
 }
 
-func iterateDirectory( dirPath string, tw *tar.Writer ) (err error) {
-	dir, er := os.Open( dirPath )
-	if er != nil {
-		err = er
-		log.Println("TarGz Error", err)
-		return
+func iterateDirectory(dirPath, rel string, filter *PathFilter, tw *tar.Writer) (err error) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return opError("TarGz", dirPath, ErrRead, err)
 	}
 	defer dir.Close()
-	fis, er := dir.Readdir( 0 )
 
-	if er != nil {
-		err = er
-		log.Println("TarGz Error", err)
-		return
+	fis, err := dir.Readdir(0)
+	if err != nil {
+		return opError("TarGz", dirPath, ErrRead, err)
 	}
 
 	for _, fi := range fis {
 		curPath := dirPath + "/" + fi.Name()
+		curRel := path.Join(rel, fi.Name())
+		if filter != nil && filter.match(curRel, fi.IsDir()) {
+			continue
+		}
 		if fi.IsDir() {
-			//TarGzWrite( curPath, tw, fi )
-			iterateDirectory( curPath, tw )
+			err = iterateDirectory(curPath, curRel, filter, tw)
 		} else {
-			//fmt.Printf( "adding... %s\n", curPath )
-			tarGzWrite( curPath, tw, fi )
+			err = tarGzWrite(curPath, tw, fi)
+		}
+		if err != nil {
+			return
 		}
 	}
 	return
 }
 
-func TarGz( outFilePath string, inPath string ) (err error) {
-	// file write
-	fw, er := os.Create( outFilePath )
+// TarGz archives the files below inPath to outFilePath. The archive is only
+// complete when no error is returned.
+func TarGz(outFilePath string, inPath string) (err error) {
+	return TarGzWithFilter(outFilePath, inPath, nil)
+}
 
-	if er != nil {
-		err = er
-		log.Println("TarGz Error", err)
-		return
+// TarGzWithFilter is TarGz leaving out the paths, relative to inPath, which
+// filter excludes.
+func TarGzWithFilter(outFilePath, inPath string, filter *PathFilter) (err error) {
+	fw, err := os.Create(outFilePath)
+	if err != nil {
+		return opError("TarGz", outFilePath, ErrWrite, err)
 	}
+	gw := gzip.NewWriter(fw)
+	tw := tar.NewWriter(gw)
 
-	defer fw.Close()
-
-	// gzip write
-	gw := gzip.NewWriter( fw )
-	defer gw.Close()
-
-	// tar write
-	tw := tar.NewWriter( gw )
-	defer tw.Close()
-
-	iterateDirectory( inPath, tw )
+	err = iterateDirectory(inPath, "", filter, tw)
 
+	// Closing flushes the tar footer and gzip trailer, which may fail too.
+	for _, c := range []io.Closer{tw, gw, fw} {
+		if er := c.Close(); er != nil && err == nil {
+			err = opError("TarGz", outFilePath, ErrWrite, er)
+		}
+	}
 	return
 }
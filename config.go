@@ -0,0 +1,362 @@
+package util
+
+import (
+	"context"
+	"encoding"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DefaultConfigPollInterval is the interval WatchConfig checks files at when
+// none is given.
+const DefaultConfigPollInterval = 2 * time.Second
+
+// ConfigOptions describes the sources of a configuration. Later sources
+// override earlier ones:
+//
+//  1. defaults from `default:"..."` struct tags
+//  2. Files, in order, decoded with Load by their extension
+//  3. environment variables
+//  4. the flags of Flags which were set on the command line
+//
+// Fields tagged `required:"true"` must be non-zero afterwards.
+//
+// Environment variables are named by EnvPrefix and the upper-case field path,
+// e.g. APP_SERVER_MAX_CONNS for the field Server.MaxConns with prefix "APP".
+// Flags are named by the lower-case field path, e.g. "server.max-conns". The
+// tags `env:"NAME"` and `flag:"name"` override the names, "-" skips the
+// field. Supported field types are strings, bools, numbers, time.Duration,
+// slices of those (comma separated) and encoding.TextUnmarshaler.
+type ConfigOptions struct {
+	Files []string
+	// RequireFiles fails on missing files instead of skipping them.
+	RequireFiles bool
+	// FileOptions are passed to Load, e.g. WithDisallowUnknownFields.
+	FileOptions []FileOption
+
+	EnvPrefix string
+	// LookupEnv defaults to os.LookupEnv.
+	LookupEnv func(string) (string, bool)
+
+	// Flags must be parsed before LoadConfig. ConfigFlags defines the flags
+	// of a configuration struct.
+	Flags *flag.FlagSet
+}
+
+// configField is a settable leaf field of a configuration struct.
+type configField struct {
+	path  string
+	value reflect.Value
+	tag   reflect.StructTag
+	env   string
+	flag  string
+}
+
+// LoadConfig fills the struct pointed to by cfg from the sources in o. A nil
+// o only applies the defaults and the environment.
+func LoadConfig(cfg interface{}, o *ConfigOptions) error {
+	if o == nil {
+		o = &ConfigOptions{}
+	}
+	fields, err := configFields(cfg, o)
+	if err != nil {
+		return opError("LoadConfig", "", ErrInvalidConfig, err)
+	}
+
+	for _, f := range fields {
+		if def, ok := f.tag.Lookup("default"); ok {
+			if err = setConfigValue(f.value, def); err != nil {
+				return opError("LoadConfig", "", ErrInvalidConfig, fmt.Errorf("default of %s: %v", f.path, err))
+			}
+		}
+	}
+
+	for _, filename := range o.Files {
+		if !o.RequireFiles && !FileExists(filename) {
+			continue
+		}
+		if err = Load(cfg, filename, o.FileOptions...); err != nil {
+			return err
+		}
+	}
+
+	lookup := o.LookupEnv
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	for _, f := range fields {
+		if f.env == "" {
+			continue
+		}
+		if v, ok := lookup(f.env); ok {
+			if err = setConfigValue(f.value, v); err != nil {
+				return opError("LoadConfig", "", ErrInvalidConfig, fmt.Errorf("%s: %v", f.env, err))
+			}
+		}
+	}
+
+	if o.Flags != nil {
+		byFlag := make(map[string]configField)
+		for _, f := range fields {
+			if f.flag != "" {
+				byFlag[f.flag] = f
+			}
+		}
+		o.Flags.Visit(func(fl *flag.Flag) {
+			f, ok := byFlag[fl.Name]
+			if !ok || err != nil {
+				return
+			}
+			if er := setConfigValue(f.value, fl.Value.String()); er != nil {
+				err = opError("LoadConfig", "", ErrInvalidConfig, fmt.Errorf("-%s: %v", fl.Name, er))
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var missing []string
+	for _, f := range fields {
+		if f.tag.Get("required") == "true" && f.value.IsZero() {
+			missing = append(missing, f.path)
+		}
+	}
+	if len(missing) > 0 {
+		return opError("LoadConfig", "", ErrInvalidConfig, fmt.Errorf("missing required %s", strings.Join(missing, ", ")))
+	}
+	return nil
+}
+
+// ConfigFlags defines a flag on fs for every field of the struct pointed to
+// by cfg, named as described for ConfigOptions. The `usage:"..."` tag sets
+// the help text. Only flags set on the command line override other sources.
+func ConfigFlags(fs *flag.FlagSet, cfg interface{}) error {
+	fields, err := configFields(cfg, &ConfigOptions{})
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if f.flag == "" || fs.Lookup(f.flag) != nil {
+			continue
+		}
+		fv := &configFlag{value: f.value.Type(), text: f.tag.Get("default")}
+		fs.Var(fv, f.flag, f.tag.Get("usage"))
+	}
+	return nil
+}
+
+// configFlag holds a flag value until LoadConfig applies it.
+type configFlag struct {
+	value reflect.Type
+	text  string
+}
+
+func (f *configFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.text
+}
+
+// Set checks s parses, so that errors are reported by flag.Parse.
+func (f *configFlag) Set(s string) error {
+	if err := setConfigValue(reflect.New(f.value).Elem(), s); err != nil {
+		return err
+	}
+	f.text = s
+	return nil
+}
+
+// IsBoolFlag allows "-debug" without a value for bool fields.
+func (f *configFlag) IsBoolFlag() bool {
+	return f.value.Kind() == reflect.Bool
+}
+
+// WatchConfig polls the files of o every interval, DefaultConfigPollInterval
+// if zero, and when one changes loads a new configuration, as returned by
+// newConfig, and passes it to onReload along with any load error. A failed
+// load leaves the running configuration to the caller. WatchConfig returns
+// when ctx is done.
+func WatchConfig(ctx context.Context, o *ConfigOptions, newConfig func() interface{}, interval time.Duration, onReload func(cfg interface{}, err error)) error {
+	if o == nil {
+		o = &ConfigOptions{}
+	}
+	if interval <= 0 {
+		interval = DefaultConfigPollInterval
+	}
+	stamp := configFilesStamp(o.Files)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if s := configFilesStamp(o.Files); s != stamp {
+			stamp = s
+			cfg := newConfig()
+			onReload(cfg, LoadConfig(cfg, o))
+		}
+	}
+}
+
+// configFilesStamp summarizes the size and modification time of files.
+func configFilesStamp(files []string) string {
+	var b strings.Builder
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			fmt.Fprintf(&b, "%d:%d;", fi.Size(), fi.ModTime().UnixNano())
+		} else {
+			b.WriteString("-;")
+		}
+	}
+	return b.String()
+}
+
+func configFields(cfg interface{}, o *ConfigOptions) ([]configField, error) {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("config must be a pointer to a struct, not %T", cfg)
+	}
+	var fields []configField
+	collectConfigFields(v.Elem(), nil, o.EnvPrefix, &fields)
+	return fields, nil
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+func collectConfigFields(v reflect.Value, path []string, envPrefix string, fields *[]configField) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		fv := v.Field(i)
+		p := append(append([]string{}, path...), sf.Name)
+
+		isText := reflect.PointerTo(sf.Type).Implements(textUnmarshalerType)
+		if !isText && sf.Type.Kind() == reflect.Struct {
+			collectConfigFields(fv, p, envPrefix, fields)
+			continue
+		}
+		if !isText && sf.Type.Kind() == reflect.Ptr && sf.Type.Elem().Kind() == reflect.Struct {
+			if fv.IsNil() {
+				fv.Set(reflect.New(sf.Type.Elem()))
+			}
+			collectConfigFields(fv.Elem(), p, envPrefix, fields)
+			continue
+		}
+
+		f := configField{path: strings.Join(p, "."), value: fv, tag: sf.Tag}
+		words := make([]string, len(p))
+		for j, name := range p {
+			words[j] = configWords(name)
+		}
+		f.env = strings.ToUpper(strings.Join(words, "_"))
+		if envPrefix != "" {
+			f.env = envPrefix + "_" + f.env
+		}
+		if name, ok := sf.Tag.Lookup("env"); ok {
+			f.env = name
+		}
+		f.flag = strings.Replace(strings.ToLower(strings.Join(words, ".")), "_", "-", -1)
+		if name, ok := sf.Tag.Lookup("flag"); ok {
+			f.flag = name
+		}
+		if f.env == "-" {
+			f.env = ""
+		}
+		if f.flag == "-" {
+			f.flag = ""
+		}
+		*fields = append(*fields, f)
+	}
+}
+
+// configWords splits a Go name into underscore separated words, e.g.
+// "HTTPMaxConns" into "HTTP_Max_Conns".
+func configWords(name string) string {
+	r := []rune(name)
+	var b strings.Builder
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) &&
+			(unicode.IsLower(r[i-1]) || i+1 < len(r) && unicode.IsLower(r[i+1]) && unicode.IsUpper(r[i-1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setConfigValue parses s into v.
+func setConfigValue(v reflect.Value, s string) error {
+	if v.CanAddr() {
+		if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			return u.UnmarshalText([]byte(s))
+		}
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		var parts []string
+		if s = strings.TrimSpace(s); s != "" {
+			parts = strings.Split(s, ",")
+		}
+		slice := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, part := range parts {
+			if err := setConfigValue(slice.Index(i), strings.TrimSpace(part)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
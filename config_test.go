@@ -0,0 +1,158 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Name   string `default:"app"`
+	Debug  bool
+	Server struct {
+		Host     string `default:"localhost" required:"true"`
+		Port     int    `default:"80"`
+		MaxConns int
+	}
+	HTTPTimeout time.Duration `default:"1s"`
+	Tags        []string
+	Secret      string `env:"SECRET" flag:"-"`
+	Internal    string `env:"-" flag:"-"`
+}
+
+func envMap(m map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := m[name]
+		return v, ok
+	}
+}
+
+func TestConfigFieldNames(t *testing.T) {
+	var cfg testConfig
+	fields, err := configFields(&cfg, &ConfigOptions{EnvPrefix: "APP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range fields {
+		got = append(got, f.path+" "+f.env+" "+f.flag)
+	}
+	want := []string{
+		"Name APP_NAME name",
+		"Debug APP_DEBUG debug",
+		"Server.Host APP_SERVER_HOST server.host",
+		"Server.Port APP_SERVER_PORT server.port",
+		"Server.MaxConns APP_SERVER_MAX_CONNS server.max-conns",
+		"HTTPTimeout APP_HTTP_TIMEOUT http-timeout",
+		"Tags APP_TAGS tags",
+		"Secret SECRET ",
+		"Internal  ",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(filename, []byte(`{"Name": "file", "Debug": true, "Server": {"Port": 8000, "MaxConns": 10}}`), 0600)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var cfg testConfig
+	if err := ConfigFlags(fs, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Parse([]string{"-server.port", "9000", "-tags", "a, b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := LoadConfig(&cfg, &ConfigOptions{
+		Files:     []string{filename, filepath.Join(t.TempDir(), "missing.json")},
+		EnvPrefix: "APP",
+		LookupEnv: envMap(map[string]string{
+			"APP_SERVER_PORT":      "8080",
+			"APP_SERVER_MAX_CONNS": "20",
+			"APP_INTERNAL":         "x",
+			"SECRET":               "s3cret",
+		}),
+		Flags: fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Defaults, then the file, the environment and the flags set.
+	if cfg.Name != "file" || !cfg.Debug || cfg.Server.Host != "localhost" || cfg.Server.Port != 9000 ||
+		cfg.Server.MaxConns != 20 || cfg.HTTPTimeout != time.Second || strings.Join(cfg.Tags, "|") != "a|b" ||
+		cfg.Secret != "s3cret" || cfg.Internal != "" {
+		t.Errorf("got %+v", cfg)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	var cfg struct {
+		Host string `required:"true"`
+		Port int    `required:"true" default:"80"`
+		DB   struct {
+			URL string `required:"true"`
+		}
+	}
+	err := LoadConfig(&cfg, &ConfigOptions{LookupEnv: envMap(nil)})
+	if !errors.Is(err, ErrInvalidConfig) || !strings.HasSuffix(err.Error(), "missing required Host, DB.URL") {
+		t.Errorf("got %v", err)
+	}
+	// Nil options read the process environment.
+	if err = LoadConfig(&cfg, nil); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("nil options: got %v", err)
+	}
+
+	err = LoadConfig(&cfg, &ConfigOptions{LookupEnv: envMap(map[string]string{"PORT": "x"})})
+	if !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), "PORT") {
+		t.Errorf("bad env: got %v", err)
+	}
+	err = LoadConfig(&cfg, &ConfigOptions{Files: []string{filepath.Join(t.TempDir(), "missing.json")}, RequireFiles: true})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: got %v", err)
+	}
+	if err = LoadConfig(cfg, nil); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("not a pointer: got %v", err)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(filename, []byte(`{"Name": "a"}`), 0600)
+	o := &ConfigOptions{Files: []string{filename}, LookupEnv: envMap(nil)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloaded := make(chan *testConfig, 1)
+	done := make(chan error)
+	go func() {
+		done <- WatchConfig(ctx, o, func() interface{} { return new(testConfig) }, 10*time.Millisecond, func(cfg interface{}, err error) {
+			if err != nil {
+				t.Error(err)
+			}
+			reloaded <- cfg.(*testConfig)
+		})
+	}()
+
+	time.Sleep(30 * time.Millisecond)
+	os.WriteFile(filename, []byte(`{"Name": "changed"}`), 0600)
+	select {
+	case cfg := <-reloaded:
+		if cfg.Name != "changed" || cfg.Server.Port != 80 {
+			t.Errorf("got %+v", cfg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reloaded")
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
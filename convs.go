@@ -2,20 +2,17 @@ package util
 
 import (
 	"strconv"
-	"log"
-	"fmt"
-//	"regexp"
 )
 
+// ParseInts parses every string as a decimal int. The error wraps
+// ErrInvalidNumber and the *strconv.NumError of the first bad value.
 func ParseInts(sids ...string) (ints []int, err error) {
-	for _,s := range sids {
+	for _, s := range sids {
 		int2add, e := strconv.Atoi(s)
 		if e != nil {
-			log.Println(fmt.Errorf("Error %v parsing %v ", e, s))
-			err = e
-			return
+			return nil, opError("ParseInts", "", ErrInvalidNumber, e)
 		}
 		ints = append(ints, int2add)
 	}
 	return
-}
\ No newline at end of file
+}
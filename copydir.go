@@ -0,0 +1,324 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// SymlinkPolicy tells CopyDirWithOptions what to do with symbolic links.
+type SymlinkPolicy int
+
+const (
+	// SymlinkFollow copies what the link points to, as CopyDir always did.
+	// Links to an ancestor directory are reported as errors.
+	SymlinkFollow SymlinkPolicy = iota
+	// SymlinkCopy recreates the link itself.
+	SymlinkCopy
+	// SymlinkSkip leaves links out.
+	SymlinkSkip
+)
+
+// CopyProgress is reported after every copied file.
+type CopyProgress struct {
+	// Files and Bytes count what was copied so far.
+	Files int64
+	Bytes int64
+	// Path is the source of the file just copied.
+	Path string
+}
+
+// CopyOptions configures CopyDirWithOptions. The zero value is usable.
+type CopyOptions struct {
+	Symlinks SymlinkPolicy
+	// Merge copies into an existing destination, overwriting files of the
+	// same name, instead of failing with ErrDestinationExists.
+	Merge bool
+	// Excludes skips entries any of which returns true for.
+	Excludes []func(os.FileInfo) bool
+	// Filter skips entries by their path relative to the source. Symbolic
+	// links do not count as directories for patterns ending in a slash.
+	Filter *PathFilter
+	// Progress is called after every copied file.
+	Progress func(CopyProgress)
+	// Preserve selects the metadata of files and directories to keep.
+	Preserve Preserve
+	// Workers copy files concurrently when more than one. Directories are
+	// still created by a single walker before their files, at most Workers
+	// files are queued, and errors are reported in the order of a
+	// sequential copy. Progress calls are serialized.
+	Workers int
+}
+
+// CopyDirWithOptions copies the directory tree source to dest. A failing
+// entry does not stop the copy; all errors are returned joined, see
+// errors.Join. Cancelling ctx stops the copy and returns ctx.Err().
+func CopyDirWithOptions(ctx context.Context, source, dest string, o *CopyOptions) error {
+	if o == nil {
+		o = &CopyOptions{}
+	}
+	fi, err := os.Stat(source)
+	if err != nil {
+		return opError("CopyDir", source, ErrRead, err)
+	}
+	if !fi.IsDir() {
+		return opError("CopyDir", source, ErrNotDirectory, nil)
+	}
+	if _, err = os.Lstat(dest); !os.IsNotExist(err) && !o.Merge {
+		return opError("CopyDir", dest, ErrDestinationExists, nil)
+	}
+
+	c := &dirCopier{ctx: ctx, o: o, root: source}
+	if o.Workers > 1 {
+		c.jobs = make(chan copyJob, o.Workers)
+		for i := 0; i < o.Workers; i++ {
+			c.wg.Add(1)
+			go c.worker()
+		}
+	}
+	c.copyDir(source, dest, fi, nil)
+	if c.jobs != nil {
+		close(c.jobs)
+		c.wg.Wait()
+	}
+
+	// Directories get their metadata once all files are in, the deepest
+	// first, so that read-only ones can be filled.
+	for i := len(c.dirs) - 1; i >= 0 && ctx.Err() == nil; i-- {
+		d := c.dirs[i]
+		if err = preserveDirMetadata(d.dest, d.source, d.fi, o.Preserve); err != nil {
+			c.failAt(d.seq, d.dest, ErrWrite, err)
+		}
+	}
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	sort.SliceStable(c.errs, func(i, j int) bool {
+		return c.errs[i].seq < c.errs[j].seq
+	})
+	errs := make([]error, len(c.errs))
+	for i, e := range c.errs {
+		errs[i] = e.err
+	}
+	return errors.Join(errs...)
+}
+
+type dirCopier struct {
+	ctx  context.Context
+	o    *CopyOptions
+	root string
+	// seq numbers the entries in walk order.
+	seq  int
+	dirs []copyJob
+
+	jobs chan copyJob
+	wg   sync.WaitGroup
+
+	mu       sync.Mutex
+	progress CopyProgress
+	errs     []copyError
+}
+
+// copyJob is a file to copy or a directory to apply metadata to.
+type copyJob struct {
+	seq          int
+	source, dest string
+	fi           os.FileInfo
+}
+
+type copyError struct {
+	seq int
+	err error
+}
+
+// fail records an error of the entry being walked.
+func (c *dirCopier) fail(path string, kind, err error) {
+	c.failAt(c.seq, path, kind, err)
+}
+
+func (c *dirCopier) failAt(seq int, path string, kind, err error) {
+	c.mu.Lock()
+	c.errs = append(c.errs, copyError{seq: seq, err: opError("CopyDir", path, kind, err)})
+	c.mu.Unlock()
+}
+
+func (c *dirCopier) worker() {
+	defer c.wg.Done()
+	for j := range c.jobs {
+		if c.ctx.Err() == nil {
+			c.copyFile(j)
+		}
+	}
+}
+
+// copyDir copies the directory source, with the info fi, to dest.
+// ancestors are the directories above it, to detect cycles of links.
+func (c *dirCopier) copyDir(source, dest string, fi os.FileInfo, ancestors []os.FileInfo) {
+	for _, a := range ancestors {
+		if os.SameFile(a, fi) {
+			c.fail(source, ErrRead, errors.New("symbolic link cycle"))
+			return
+		}
+	}
+	root := len(ancestors) == 0
+	ancestors = append(ancestors, fi)
+	if c.o.Preserve != 0 {
+		c.dirs = append(c.dirs, copyJob{seq: c.seq, source: source, dest: dest, fi: fi})
+	}
+
+	// Only the root may be a link to a directory, below it a merge replaces
+	// whatever is not a directory rather than write through it.
+	stat := os.Lstat
+	if root {
+		stat = os.Stat
+	}
+	di, err := stat(dest)
+	if err == nil && !di.IsDir() {
+		if root {
+			c.fail(dest, ErrNotDirectory, nil)
+			return
+		}
+		if err = os.Remove(dest); err != nil {
+			c.fail(dest, ErrWrite, err)
+			return
+		}
+	}
+	if err != nil || !di.IsDir() {
+		if err = os.MkdirAll(dest, 0777); err != nil {
+			c.fail(dest, ErrWrite, err)
+			return
+		}
+	}
+
+	entries, err := os.ReadDir(source)
+	if err != nil {
+		c.fail(source, ErrRead, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.seq++
+		sfp := filepath.Join(source, entry.Name())
+		dfp := filepath.Join(dest, entry.Name())
+
+		info, err := entry.Info()
+		if err != nil {
+			c.fail(sfp, ErrRead, err)
+			continue
+		}
+		if c.excluded(sfp, info) {
+			continue
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch c.o.Symlinks {
+			case SymlinkSkip:
+				continue
+			case SymlinkCopy:
+				c.copyLink(sfp, dfp)
+				continue
+			}
+			if info, err = os.Stat(sfp); err != nil {
+				c.fail(sfp, ErrRead, err)
+				continue
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			c.copyDir(sfp, dfp, info, ancestors)
+		case info.Mode().IsRegular():
+			j := copyJob{seq: c.seq, source: sfp, dest: dfp, fi: info}
+			if c.jobs == nil {
+				c.copyFile(j)
+				continue
+			}
+			select {
+			case c.jobs <- j:
+			case <-c.ctx.Done():
+			}
+		default:
+			c.fail(sfp, ErrRead, fmt.Errorf("cannot copy %v", info.Mode().Type()))
+		}
+	}
+}
+
+func (c *dirCopier) excluded(path string, fi os.FileInfo) bool {
+	if c.o.Filter != nil {
+		// Excluded directories are not descended into, so the parents
+		// need no check.
+		if rel, err := filepath.Rel(c.root, path); err == nil && c.o.Filter.match(filepath.ToSlash(rel), fi.IsDir()) {
+			return true
+		}
+	}
+	for _, pred := range c.o.Excludes {
+		if pred(fi) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *dirCopier) copyLink(source, dest string) {
+	target, err := os.Readlink(source)
+	if err != nil {
+		c.fail(source, ErrRead, err)
+		return
+	}
+	if c.o.Merge {
+		if err = os.Remove(dest); err != nil && !os.IsNotExist(err) {
+			c.fail(dest, ErrWrite, err)
+			return
+		}
+	}
+	if err = os.Symlink(target, dest); err != nil {
+		c.fail(dest, ErrWrite, err)
+		return
+	}
+	if c.o.Preserve&PreserveOwner != 0 {
+		if fi, err := os.Lstat(source); err == nil {
+			if uid, gid, ok := fileOwner(fi); ok {
+				if err = os.Lchown(dest, uid, gid); err != nil && !os.IsPermission(err) {
+					c.fail(dest, ErrWrite, err)
+				}
+			}
+		}
+	}
+}
+
+func (c *dirCopier) copyFile(j copyJob) {
+	if c.o.Merge {
+		// Replace rather than write through a symbolic link, or anything
+		// else but a regular file, left at dest.
+		if fi, err := os.Lstat(j.dest); err == nil && !fi.Mode().IsRegular() {
+			if err = os.Remove(j.dest); err != nil {
+				c.failAt(j.seq, j.dest, ErrWrite, err)
+				return
+			}
+		}
+	}
+	n, err := copyFileContents(c.ctx, j.source, j.dest, j.fi, c.o.Preserve)
+	if err != nil && c.ctx.Err() == nil {
+		c.failAt(j.seq, j.source, ErrWrite, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.progress.Bytes += n
+	if err != nil {
+		return
+	}
+	c.progress.Files++
+	if c.o.Progress != nil {
+		c.progress.Path = j.source
+		c.o.Progress(c.progress)
+	}
+}
@@ -0,0 +1,123 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyDirMergeReplacesSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	src, dst, outside := filepath.Join(dir, "src"), filepath.Join(dir, "dst"), filepath.Join(dir, "outside")
+	os.Mkdir(src, 0755)
+	os.Mkdir(dst, 0755)
+	os.WriteFile(filepath.Join(src, "f"), []byte("new"), 0644)
+	os.WriteFile(outside, []byte("keep"), 0644)
+	if err := os.Symlink(outside, filepath.Join(dst, "f")); err != nil {
+		t.Skip(err)
+	}
+
+	if err := CopyDirWithOptions(context.Background(), src, dst, &CopyOptions{Merge: true}); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(outside); string(b) != "keep" {
+		t.Errorf("wrote through the link: %q", b)
+	}
+	fi, err := os.Lstat(filepath.Join(dst, "f"))
+	if err != nil || !fi.Mode().IsRegular() {
+		t.Fatalf("dest is %v, %v", fi, err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dst, "f")); string(b) != "new" {
+		t.Errorf("got %q", b)
+	}
+}
+
+func TestCopyDirMergeReplacesLinkedDirs(t *testing.T) {
+	dir := t.TempDir()
+	src, dst, outside := filepath.Join(dir, "src"), filepath.Join(dir, "dst"), filepath.Join(dir, "outside")
+	for _, d := range []string{"src/sub", "src/other", "dst", "outside"} {
+		os.MkdirAll(filepath.Join(dir, d), 0755)
+	}
+	os.WriteFile(filepath.Join(src, "sub", "f"), []byte("new"), 0644)
+	os.WriteFile(filepath.Join(src, "other", "f"), []byte("new"), 0644)
+	os.WriteFile(filepath.Join(outside, "f"), []byte("keep"), 0644)
+	os.WriteFile(filepath.Join(dst, "other"), []byte("file"), 0644)
+	if err := os.Symlink(outside, filepath.Join(dst, "sub")); err != nil {
+		t.Skip(err)
+	}
+
+	if err := CopyDirWithOptions(context.Background(), src, dst, &CopyOptions{Merge: true}); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(outside, "f")); string(b) != "keep" {
+		t.Errorf("wrote through the link: %q", b)
+	}
+	for _, name := range []string{"sub", "other"} {
+		if fi, err := os.Lstat(filepath.Join(dst, name)); err != nil || !fi.IsDir() {
+			t.Errorf("%s is %v, %v", name, fi, err)
+		}
+		if b, _ := os.ReadFile(filepath.Join(dst, name, "f")); string(b) != "new" {
+			t.Errorf("%s/f = %q", name, b)
+		}
+	}
+}
+
+// makeTree creates dirs directories of files small files each in dir.
+func makeTree(tb testing.TB, dir string, dirs, files int) {
+	data := make([]byte, 512)
+	for i := 0; i < dirs; i++ {
+		sub := filepath.Join(dir, fmt.Sprint("d", i))
+		if err := os.MkdirAll(sub, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		for j := 0; j < files; j++ {
+			if err := os.WriteFile(filepath.Join(sub, fmt.Sprint("f", j)), data, 0644); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestCopyDirWorkersReportSameErrors(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	makeTree(t, src, 5, 20)
+	// Non-empty directories in place of some files make their copies fail.
+	for _, name := range []string{"d0/f3", "d2/f7", "d2/f11", "d4/f0"} {
+		os.MkdirAll(filepath.Join(dst, name, "x"), 0755)
+	}
+
+	var want string
+	for _, workers := range []int{0, 8, 8, 1, 8} {
+		err := CopyDirWithOptions(context.Background(), src, dst, &CopyOptions{Merge: true, Workers: workers})
+		if err == nil {
+			t.Fatalf("workers %d: no error", workers)
+		}
+		if want == "" {
+			want = err.Error()
+		} else if err.Error() != want {
+			t.Errorf("workers %d: got\n%v\nwant\n%v", workers, err, want)
+		}
+	}
+}
+
+func BenchmarkCopyDir(b *testing.B) {
+	dir := b.TempDir()
+	src := filepath.Join(dir, "src")
+	makeTree(b, src, 20, 100)
+	for _, workers := range []int{0, 4, 16} {
+		b.Run(fmt.Sprint("Workers=", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				dst := filepath.Join(dir, "dst")
+				if err := CopyDirWithOptions(context.Background(), src, dst, &CopyOptions{Workers: workers}); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				os.RemoveAll(dst)
+				b.StartTimer()
+			}
+		})
+	}
+}
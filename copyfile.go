@@ -0,0 +1,144 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Preserve selects the metadata CopyFileWithOptions and CopyDirWithOptions
+// carry over to copies.
+type Preserve int
+
+const (
+	// PreserveMode keeps the permission bits, including setuid, setgid
+	// and sticky.
+	PreserveMode Preserve = 1 << iota
+	// PreserveTimes keeps the modification time.
+	PreserveTimes
+	// PreserveOwner keeps the user and group where permitted, i.e. usually
+	// only for root. Failures for lack of permission are ignored.
+	PreserveOwner
+	// PreserveXattrs keeps extended attributes, on Linux only. Attributes
+	// which cannot be set, e.g. trusted.* for non-root, are skipped.
+	PreserveXattrs
+
+	PreserveAll = PreserveMode | PreserveTimes | PreserveOwner | PreserveXattrs
+)
+
+// CopyFileWithOptions copies the regular file source to dest, keeping the
+// metadata selected by preserve. On Linux the data is cloned (reflink) or
+// copied in the kernel with copy_file_range when possible, falling back to
+// a plain copy.
+func CopyFileWithOptions(ctx context.Context, source, dest string, preserve Preserve) error {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return opError("CopyFile", source, ErrRead, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return opError("CopyFile", source, ErrRead, errors.New("not a regular file"))
+	}
+	if _, err = copyFileContents(ctx, source, dest, fi, preserve); err != nil {
+		return opError("CopyFile", dest, ErrWrite, err)
+	}
+	return nil
+}
+
+// copyFileContents copies the regular file source, with the info fi, to dest
+// and returns the number of bytes copied.
+func copyFileContents(ctx context.Context, source, dest string, fi os.FileInfo, preserve Preserve) (n int64, err error) {
+	sf, err := os.Open(source)
+	if err != nil {
+		return 0, err
+	}
+	defer sf.Close()
+
+	perm := os.FileMode(0666)
+	if preserve&PreserveMode != 0 {
+		perm = fi.Mode().Perm()
+	}
+	df, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if er := df.Close(); err == nil {
+			err = er
+		}
+	}()
+	return copyOpenFile(ctx, df, sf, fi, preserve)
+}
+
+// copyOpenFile copies sf, a regular file with the info fi, into the empty
+// file df and returns the number of bytes copied.
+func copyOpenFile(ctx context.Context, df, sf *os.File, fi os.FileInfo, preserve Preserve) (int64, error) {
+	n, ok, err := fastCopy(ctx, df, sf, fi.Size())
+	if err != nil {
+		return n, err
+	}
+	if !ok {
+		if n, err = io.Copy(df, &contextReader{ctx: ctx, r: sf}); err != nil {
+			return n, err
+		}
+	}
+	return n, preserveMetadata(df, sf.Name(), fi, preserve)
+}
+
+// preserveMetadata applies the metadata of source, with the info fi, to the
+// open file f. The order matters: chown clears setuid bits and read-only
+// files may refuse xattrs.
+func preserveMetadata(f *os.File, source string, fi os.FileInfo, preserve Preserve) error {
+	if preserve&PreserveOwner != 0 {
+		if uid, gid, ok := fileOwner(fi); ok {
+			if err := f.Chown(uid, gid); err != nil && !os.IsPermission(err) {
+				return err
+			}
+		}
+	}
+	if preserve&PreserveXattrs != 0 {
+		if err := copyXattrs(f, source); err != nil {
+			return err
+		}
+	}
+	if preserve&PreserveMode != 0 {
+		if err := f.Chmod(fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	if preserve&PreserveTimes != 0 {
+		if err := os.Chtimes(f.Name(), time.Time{}, fi.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preserveDirMetadata applies the metadata of the directory source to dir,
+// after its entries were copied so that their creation does not touch its
+// time.
+func preserveDirMetadata(dir, source string, fi os.FileInfo, preserve Preserve) error {
+	if preserve == 0 {
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return preserveMetadata(f, source, fi, preserve)
+}
+
+// contextReader fails reads once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,77 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyChunk bounds a single copy_file_range call, so that cancellation is
+// noticed during large copies.
+const copyChunk = 8 << 20
+
+// fastCopy clones src into the empty dst or copies it in the kernel. ok is
+// false when neither is supported and nothing was copied. Files reporting
+// no size or yielding nothing, like those in /proc, are left to a plain
+// copy, as their size says nothing about their content.
+func fastCopy(ctx context.Context, dst, src *os.File, size int64) (n int64, ok bool, err error) {
+	if size == 0 {
+		return 0, false, nil
+	}
+	if unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())) == nil {
+		return size, true, nil
+	}
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return n, true, err
+		}
+		c, er := unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, copyChunk, 0)
+		if er != nil {
+			if n == 0 && (errors.Is(er, unix.EXDEV) || errors.Is(er, unix.ENOSYS) ||
+				errors.Is(er, unix.EOPNOTSUPP) || errors.Is(er, unix.EINVAL) || errors.Is(er, unix.EPERM)) {
+				return 0, false, nil
+			}
+			return n, true, er
+		}
+		if c == 0 {
+			return n, n > 0, nil
+		}
+		n += int64(c)
+	}
+}
+
+// copyXattrs copies the extended attributes of source to f, skipping those
+// which cannot be set.
+func copyXattrs(f *os.File, source string) error {
+	size, err := unix.Listxattr(source, nil)
+	if err != nil || size == 0 {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+		return err
+	}
+	list := make([]byte, size)
+	if size, err = unix.Listxattr(source, list); err != nil {
+		return err
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(list[:size]), "\x00"), "\x00") {
+		vsize, err := unix.Getxattr(source, name, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, vsize)
+		if vsize, err = unix.Getxattr(source, name, value); err != nil {
+			return err
+		}
+		err = unix.Fsetxattr(int(f.Fd()), name, value[:vsize], 0)
+		if err != nil && !errors.Is(err, unix.EPERM) && !errors.Is(err, unix.ENOTSUP) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package util
+
+import (
+	"context"
+	"os"
+)
+
+// fastCopy is only implemented on Linux.
+func fastCopy(ctx context.Context, dst, src *os.File, size int64) (int64, bool, error) {
+	return 0, false, nil
+}
+
+// copyXattrs is only implemented on Linux.
+func copyXattrs(f *os.File, source string) error {
+	return nil
+}
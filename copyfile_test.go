@@ -0,0 +1,40 @@
+package util
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyFileWithOptions(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	os.WriteFile(src, []byte("content"), 0640)
+	if err := CopyFileWithOptions(context.Background(), src, dst, PreserveMode|PreserveTimes); err != nil {
+		t.Fatal(err)
+	}
+	sfi, _ := os.Stat(src)
+	dfi, _ := os.Stat(dst)
+	if b, _ := os.ReadFile(dst); string(b) != "content" {
+		t.Errorf("got %q", b)
+	}
+	if dfi.Mode() != sfi.Mode() || !dfi.ModTime().Equal(sfi.ModTime()) {
+		t.Errorf("got %v %v, want %v %v", dfi.Mode(), dfi.ModTime(), sfi.Mode(), sfi.ModTime())
+	}
+}
+
+func TestCopyFileWithoutSize(t *testing.T) {
+	// Files in /proc report a size of 0 but have content.
+	const src = "/proc/self/status"
+	if _, err := os.Stat(src); err != nil {
+		t.Skip(err)
+	}
+	dst := filepath.Join(t.TempDir(), "status")
+	if err := CopyFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(dst); fi.Size() == 0 {
+		t.Error("copied nothing")
+	}
+}
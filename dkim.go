@@ -0,0 +1,413 @@
+package util
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// DKIM canonicalization algorithms, see RFC 6376 section 3.4.
+const (
+	DKIMSimple  = "simple"
+	DKIMRelaxed = "relaxed"
+)
+
+// DefaultDKIMHeaders are signed when DKIMOptions.Headers is empty. Headers
+// missing from a message are skipped.
+var DefaultDKIMHeaders = []string{
+	"From", "Sender", "Reply-To", "To", "Cc", "Subject", "Date", "Message-ID",
+	"In-Reply-To", "References", "Mime-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMOptions configures DKIM signing of outgoing messages.
+type DKIMOptions struct {
+	// Domain (d=) and Selector (s=) locate the public key at
+	// <Selector>._domainkey.<Domain>.
+	Domain   string
+	Selector string
+	// Signer is an *rsa.PrivateKey (rsa-sha256) or ed25519.PrivateKey
+	// (ed25519-sha256).
+	Signer crypto.Signer
+	// Headers to sign, DefaultDKIMHeaders if empty. From is always signed.
+	Headers []string
+	// HeaderCanonicalization and BodyCanonicalization are DKIMSimple or
+	// DKIMRelaxed, DKIMRelaxed if empty.
+	HeaderCanonicalization string
+	BodyCanonicalization   string
+}
+
+func (o *DKIMOptions) validate() error {
+	if o.Domain == "" || o.Selector == "" {
+		return errors.New("dkim: domain and selector are required")
+	}
+	if _, err := dkimAlgorithm(o.Signer); err != nil {
+		return err
+	}
+	for _, c := range []string{o.HeaderCanonicalization, o.BodyCanonicalization} {
+		if c != "" && c != DKIMSimple && c != DKIMRelaxed {
+			return fmt.Errorf("dkim: unknown canonicalization %q", c)
+		}
+	}
+	return nil
+}
+
+func dkimAlgorithm(signer crypto.Signer) (string, error) {
+	switch signer.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil
+	}
+	return "", fmt.Errorf("dkim: unsupported key type %T", signer)
+}
+
+func orRelaxed(c string) string {
+	if c == "" {
+		return DKIMRelaxed
+	}
+	return c
+}
+
+// NewDKIMTransport returns a wrapper which DKIM-signs every message before
+// handing it to the wrapped Transport. An error is returned only for invalid
+// options. Apply it to a single Transport, e.g. for SendEmailVia, or register
+// it with UseEmailMiddleware to sign all mail sent by SendEmail.
+func NewDKIMTransport(o DKIMOptions) (func(Transport) Transport, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	return func(t Transport) Transport {
+		return &dkimTransport{Transport: t, options: o}
+	}, nil
+}
+
+type dkimTransport struct {
+	Transport
+	options DKIMOptions
+}
+
+func (t *dkimTransport) Send(from string, to []string, msg io.WriterTo) error {
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return err
+	}
+	signed, err := DKIMSign(buf.Bytes(), &t.options)
+	if err != nil {
+		return err
+	}
+	return t.Transport.Send(from, to, bytes.NewReader(signed))
+}
+
+// DKIMSign returns raw with a DKIM-Signature header prepended.
+func DKIMSign(raw []byte, o *DKIMOptions) ([]byte, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	algo, _ := dkimAlgorithm(o.Signer)
+	hc, bc := orRelaxed(o.HeaderCanonicalization), orRelaxed(o.BodyCanonicalization)
+
+	fields, body := splitMessage(raw)
+
+	bodyHash := sha256.Sum256(canonicalBody(body, bc))
+
+	names := o.Headers
+	if len(names) == 0 {
+		names = DefaultDKIMHeaders
+	}
+	var signed []string
+	hasFrom := false
+	for _, name := range names {
+		if headerFieldIndex(fields, name, nil) >= 0 {
+			signed = append(signed, name)
+			hasFrom = hasFrom || strings.EqualFold(name, "From")
+		}
+	}
+	if !hasFrom {
+		signed = append([]string{"From"}, signed...)
+	}
+
+	value := fmt.Sprintf("v=1; a=%s; c=%s/%s; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		algo, hc, bc, o.Domain, o.Selector, time.Now().Unix(),
+		strings.Join(signed, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	sig, err := dkimSignature(fields, signed, "DKIM-Signature: "+value, hc, o.Signer)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.WriteString("DKIM-Signature: ")
+	out.WriteString(value)
+	out.WriteString(base64.StdEncoding.EncodeToString(sig))
+	out.WriteString("\r\n")
+	out.Write(raw)
+	return out.Bytes(), nil
+}
+
+// dkimSignature signs the selected headers followed by the signature header
+// itself, which must end with an empty b= tag.
+func dkimSignature(fields []string, signed []string, sigField, hc string, signer crypto.Signer) ([]byte, error) {
+	h := sha256.New()
+	h.Write(dkimHeaderHashInput(fields, signed, hc))
+	h.Write(bytes.TrimSuffix(canonicalHeader(sigField, hc), []byte("\r\n")))
+	digest := h.Sum(nil)
+
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		return signer.Sign(rand.Reader, digest, crypto.Hash(0))
+	}
+	return signer.Sign(rand.Reader, digest, crypto.SHA256)
+}
+
+func dkimHeaderHashInput(fields []string, signed []string, hc string) []byte {
+	var b bytes.Buffer
+	used := make(map[int]bool)
+	for _, name := range signed {
+		// Multiple instances of a header are signed bottom-up.
+		if i := headerFieldIndex(fields, name, used); i >= 0 {
+			used[i] = true
+			b.Write(canonicalHeader(fields[i], hc))
+		}
+	}
+	return b.Bytes()
+}
+
+// VerifyDKIM checks the first DKIM-Signature of raw against key. Key lookup in
+// DNS is left to the caller, see ParseDKIMPublicKey.
+func VerifyDKIM(raw []byte, key crypto.PublicKey) error {
+	fields, body := splitMessage(raw)
+
+	sigIndex := -1
+	for i := range fields {
+		if strings.EqualFold(headerFieldName(fields[i]), "DKIM-Signature") {
+			sigIndex = i
+			break
+		}
+	}
+	if sigIndex < 0 {
+		return errors.New("dkim: no signature")
+	}
+	sigField := fields[sigIndex]
+	tags := parseDKIMTags(sigField[strings.Index(sigField, ":")+1:])
+
+	hc, bc := DKIMSimple, DKIMSimple
+	if c := tags["c"]; c != "" {
+		parts := strings.SplitN(c, "/", 2)
+		hc = parts[0]
+		if len(parts) == 2 {
+			bc = parts[1]
+		}
+	}
+
+	bodyHash := sha256.Sum256(canonicalBody(body, bc))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return errors.New("dkim: body hash mismatch")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("dkim: bad signature encoding: %v", err)
+	}
+
+	var signed []string
+	for _, name := range strings.Split(tags["h"], ":") {
+		signed = append(signed, strings.TrimSpace(name))
+	}
+
+	others := append(append([]string{}, fields[:sigIndex]...), fields[sigIndex+1:]...)
+	h := sha256.New()
+	h.Write(dkimHeaderHashInput(others, signed, hc))
+	h.Write(bytes.TrimSuffix(canonicalHeader(stripDKIMSignatureValue(sigField), hc), []byte("\r\n")))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, digest, sig) {
+			err = errors.New("ed25519 verification failed")
+		}
+	default:
+		err = fmt.Errorf("unsupported key type %T", key)
+	}
+	if err != nil {
+		return fmt.Errorf("dkim: %v", err)
+	}
+	return nil
+}
+
+// DKIMPublicKeyRecord returns the DNS TXT record publishing pub.
+func DKIMPublicKeyRecord(pub crypto.PublicKey) (string, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(k), nil
+	}
+	return "", fmt.Errorf("dkim: unsupported key type %T", pub)
+}
+
+// ParseDKIMPublicKey parses a DKIM DNS TXT record.
+func ParseDKIMPublicKey(record string) (crypto.PublicKey, error) {
+	tags := parseDKIMTags(record)
+	der, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(der) == 0 {
+		return nil, errors.New("dkim: missing or malformed p= tag")
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			// Some records carry a bare PKCS#1 key.
+			return x509.ParsePKCS1PublicKey(der)
+		}
+		return pub, nil
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, errors.New("dkim: bad ed25519 key size")
+		}
+		return ed25519.PublicKey(der), nil
+	}
+	return nil, fmt.Errorf("dkim: unsupported key type %q", tags["k"])
+}
+
+// splitMessage returns the header fields, each with its folded continuation
+// lines and trailing CRLF, and the body. Bare LFs are converted to CRLF.
+func splitMessage(raw []byte) (fields []string, body []byte) {
+	if !bytes.Contains(raw, []byte("\r\n")) {
+		raw = bytes.Replace(raw, []byte("\n"), []byte("\r\n"), -1)
+	}
+
+	rest := raw
+	for len(rest) > 0 {
+		i := bytes.Index(rest, []byte("\r\n"))
+		if i < 0 {
+			i = len(rest)
+		}
+		line := string(rest[:i])
+		if i == len(rest) {
+			rest = nil
+		} else {
+			rest = rest[i+2:]
+		}
+		if line == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line + "\r\n"
+		} else {
+			fields = append(fields, line+"\r\n")
+		}
+	}
+	return fields, rest
+}
+
+func headerFieldName(field string) string {
+	if i := strings.Index(field, ":"); i >= 0 {
+		return strings.TrimSpace(field[:i])
+	}
+	return ""
+}
+
+// headerFieldIndex returns the index of the last field called name which is
+// not in used, or -1.
+func headerFieldIndex(fields []string, name string, used map[int]bool) int {
+	for i := len(fields) - 1; i >= 0; i-- {
+		if !used[i] && strings.EqualFold(headerFieldName(fields[i]), name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func canonicalHeader(field, c string) []byte {
+	if c == DKIMSimple {
+		if !strings.HasSuffix(field, "\r\n") {
+			field += "\r\n"
+		}
+		return []byte(field)
+	}
+	i := strings.Index(field, ":")
+	name := strings.ToLower(strings.TrimSpace(field[:i]))
+	value := strings.Replace(field[i+1:], "\r\n", "", -1)
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return []byte(name + ":" + value + "\r\n")
+}
+
+func canonicalBody(body []byte, c string) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	if c == DKIMRelaxed {
+		for i, l := range lines {
+			l = strings.TrimRightFunc(l, isWSP)
+			lines[i] = strings.Join(strings.FieldsFunc(l, isWSP), " ")
+			if strings.IndexFunc(l, isWSP) == 0 && lines[i] != "" {
+				lines[i] = " " + lines[i]
+			}
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if c == DKIMRelaxed {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+func parseDKIMTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, kv := range strings.Split(s, ";") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		k := strings.TrimSpace(kv[:i])
+		v := strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, kv[i+1:])
+		tags[k] = v
+	}
+	return tags
+}
+
+// stripDKIMSignatureValue empties the b= tag keeping everything else intact.
+func stripDKIMSignatureValue(field string) string {
+	i := strings.Index(field, ":") + 1
+	for i < len(field) {
+		end := strings.Index(field[i:], ";")
+		if end < 0 {
+			end = len(field)
+		} else {
+			end += i
+		}
+		tag := field[i:end]
+		if eq := strings.Index(tag, "="); eq >= 0 && strings.TrimSpace(tag[:eq]) == "b" {
+			return field[:i+eq+1] + field[end:]
+		}
+		i = end + 1
+	}
+	return field
+}
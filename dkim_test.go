@@ -0,0 +1,175 @@
+package util
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// The example of RFC 8463 Appendix A, signed with both keys.
+const (
+	rfc8463Ed25519Seed   = "nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A="
+	rfc8463Ed25519Record = "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+	rfc8463RSARecord     = "v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDkHlOQoBTzWR" +
+		"iGs5V6NpP3idY6Wk08a5qhdR6wy5bdOKb2jLQiY/J16JYi0Qvx/byYzCNb3W91y3FutAC" +
+		"DfzwQ/BC/e/8uBsCR+yz1Lxj+PL6lHvqMKrM3rG4hstT5QjvHO9PzoxZyVYLzBfO2EeC3" +
+		"Ip3G+2kryOTIKT+l/K4w3QIDAQAB"
+
+	rfc8463Ed25519Signature = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+		" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n"
+	rfc8463RSASignature = "DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=test; t=1528637909; h=from : to : subject :\r\n" +
+		" date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=F45dVWDfMbQDGHJFlXUNB2HKfbCeLRyhDXgFpEL8GwpsRe0IeIixNTe3\r\n" +
+		" DhCVlUrSjV4BwcVcOF6+FF3Zo9Rpo1tFOeS9mPYQTnGdaSGsgeefOsk2Jz\r\n" +
+		" dA+L10TeYt9BgDfQNZtKdN1WO//KgIqXP7OdEFE4LjFYNcUxZQ4FADY+8=\r\n"
+	rfc8463Message = "From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"\r\n" +
+		"Hi.\r\n" +
+		"\r\n" +
+		"We lost the game.  Are you hungry yet?\r\n" +
+		"\r\n" +
+		"Joe.\r\n"
+)
+
+func TestVerifyDKIMRFC8463(t *testing.T) {
+	for _, c := range []struct{ record, signature string }{
+		{rfc8463Ed25519Record, rfc8463Ed25519Signature},
+		{rfc8463RSARecord, rfc8463RSASignature},
+	} {
+		key, err := ParseDKIMPublicKey(c.record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = VerifyDKIM([]byte(c.signature+rfc8463Message), key); err != nil {
+			t.Errorf("%T: %v", key, err)
+		}
+		tampered := strings.Replace(rfc8463Message, "Is dinner ready?", "Is lunch ready?", 1)
+		if err = VerifyDKIM([]byte(c.signature+tampered), key); err == nil {
+			t.Errorf("%T: tampered message verified", key)
+		}
+	}
+}
+
+// Ed25519 signatures are deterministic, so signing the header of the vector
+// must reproduce its b= value.
+func TestDKIMSignatureRFC8463Ed25519(t *testing.T) {
+	seed, _ := base64.StdEncoding.DecodeString(rfc8463Ed25519Seed)
+	key := ed25519.NewKeyFromSeed(seed)
+
+	fields, body := splitMessage([]byte(rfc8463Message))
+	bodyHash := sigTag(t, rfc8463Ed25519Signature, "bh")
+	sum := sha256.Sum256(canonicalBody(body, DKIMRelaxed))
+	if got := base64.StdEncoding.EncodeToString(sum[:]); got != bodyHash {
+		t.Errorf("body hash %s, want %s", got, bodyHash)
+	}
+
+	var signed []string
+	for _, name := range strings.Split(sigTag(t, rfc8463Ed25519Signature, "h"), ":") {
+		signed = append(signed, strings.TrimSpace(name))
+	}
+	sigField := stripDKIMSignatureValue(rfc8463Ed25519Signature)
+	sig, err := dkimSignature(fields, signed, sigField, DKIMRelaxed, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := base64.StdEncoding.EncodeToString(sig), sigTag(t, rfc8463Ed25519Signature, "b"); got != want {
+		t.Errorf("b=%s, want %s", got, want)
+	}
+}
+
+func TestDKIMSignRoundTrip(t *testing.T) {
+	seed, _ := base64.StdEncoding.DecodeString(rfc8463Ed25519Seed)
+	o := &DKIMOptions{Domain: "football.example.com", Selector: "brisbane", Signer: ed25519.NewKeyFromSeed(seed)}
+	for _, c := range []string{DKIMSimple, DKIMRelaxed} {
+		o.HeaderCanonicalization, o.BodyCanonicalization = c, c
+		signed, err := DKIMSign([]byte(rfc8463Message), o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, _ := ParseDKIMPublicKey(rfc8463Ed25519Record)
+		if err = VerifyDKIM(signed, key); err != nil {
+			t.Errorf("%s: %v", c, err)
+		}
+	}
+}
+
+// The example of RFC 6376 section 3.4.5.
+func TestDKIMCanonicalizationRFC6376(t *testing.T) {
+	fields, body := splitMessage([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	if len(fields) != 2 {
+		t.Fatalf("got %d fields", len(fields))
+	}
+
+	var relaxed, simple string
+	for _, f := range fields {
+		relaxed += string(canonicalHeader(f, DKIMRelaxed))
+		simple += string(canonicalHeader(f, DKIMSimple))
+	}
+	if want := "a:X\r\nb:Y Z\r\n"; relaxed != want {
+		t.Errorf("relaxed header %q, want %q", relaxed, want)
+	}
+	if want := "A: X\r\nB : Y\t\r\n\tZ  \r\n"; simple != want {
+		t.Errorf("simple header %q, want %q", simple, want)
+	}
+
+	if got, want := string(canonicalBody(body, DKIMRelaxed)), " C\r\nD E\r\n"; got != want {
+		t.Errorf("relaxed body %q, want %q", got, want)
+	}
+	if got, want := string(canonicalBody(body, DKIMSimple)), " C \r\nD \t E\r\n"; got != want {
+		t.Errorf("simple body %q, want %q", got, want)
+	}
+}
+
+func TestUseEmailMiddlewareRemove(t *testing.T) {
+	seed, _ := base64.StdEncoding.DecodeString(rfc8463Ed25519Seed)
+	mw, err := NewDKIMTransport(DKIMOptions{Domain: "example.com", Selector: "s", Signer: ed25519.NewKeyFromSeed(seed)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mt MemoryTransport
+	remove := UseEmailMiddleware(mw)
+	err = SendEmailVia(&mt, "a@example.com", "Hello", "hi", "b@example.com")
+	remove()
+	remove()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SendEmailVia(&mt, "a@example.com", "Hello", "hi", "b@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := mt.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages", len(msgs))
+	}
+	if !strings.HasPrefix(string(msgs[0].Raw), "DKIM-Signature:") {
+		t.Error("first message is not signed")
+	}
+	if strings.Contains(string(msgs[1].Raw), "DKIM-Signature:") {
+		t.Error("message signed after removing the middleware")
+	}
+}
+
+func sigTag(t *testing.T, field, name string) string {
+	t.Helper()
+	v, ok := parseDKIMTags(field[strings.Index(field, ":")+1:])[name]
+	if !ok {
+		t.Fatalf("no %s= tag", name)
+	}
+	return v
+}
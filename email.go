@@ -2,93 +2,60 @@ package util
 
 import (
 	"gopkg.in/gomail.v2"
-	"crypto/tls"
-	"log"
-	"net"
-	"strconv"
-	"html/template"
-	"bytes"
-	"regexp"
 )
 
-var parsedEmailTemplates map[string]*template.Template
-
 func SendHtmlEmail(serverAddress string, pass string, from string, subject string, templates []string, params map[string]interface{} , to ...string) (err error)  {
 
-	host, portStr, er := net.SplitHostPort(serverAddress)
-
-	if er != nil {
-		err = er
-		log.Printf("Error in Email server config %v err: %v", serverAddress, err)
-		return
+	t, err := NewSMTPTransport(serverAddress, from, pass)
+	if err != nil {
+		return opError("SendHtmlEmail", serverAddress, ErrInvalidConfig, err)
 	}
 
-	if port, er := strconv.Atoi(portStr); er == nil {
-                if parsedEmailTemplates == nil {
-			parsedEmailTemplates = make(map[string]*template.Template)
-		}
-		if parsedEmailTemplates[templates[0]] == nil {
-			parsedEmailTemplates[templates[0]] = ParseTemplate(templates...)
-		}
-		var body bytes.Buffer
-		parsedEmailTemplates[templates[0]].Execute(&body, params)
-		m := gomail.NewMessage()
-		m.SetHeader("From", from)
-		m.SetHeader("To", to...)
-		m.SetHeader("Subject", subject)
-		m.SetBody("text/html", body.String())
-		//m.Attach("/home/ekzeb/image.jpg")
-
-		d := gomail.NewDialer(host, port, from, pass)
-		d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	return SendHtmlEmailVia(t, from, subject, templates, params, to...)
+}
 
-		if err = d.DialAndSend(m); err != nil {
-			log.Printf("Error sending Email %v", body)
-		}
-	} else {
-		err = er
-		log.Printf("Error in Email server config no port '%v' err: %v", portStr, err)
-		return
+// SendHtmlEmailVia renders subject and templates with params, see RenderEmail,
+// and sends the result through t.
+func SendHtmlEmailVia(t Transport, from string, subject string, templates []string, params map[string]interface{}, to ...string) (err error) {
+	r, err := RenderEmail(subject, templates, params)
+	if err != nil {
+		return opError("SendHtmlEmail", "", ErrTemplate, err)
 	}
 
+	if err = SendMessage(t, r.Message(from, to...)); err != nil {
+		return opError("SendHtmlEmail", "", ErrSend, err)
+	}
 	return
 }
 
 func SendEmail(serverAddress string, pass string, from string, subject, body string, to ...string) (err error)  {
 
-	host, portStr, er := net.SplitHostPort(serverAddress)
-
-	if er != nil {
-		err = er
-		log.Printf("Error in Email server config %v err: %v", serverAddress, err)
-		return
+	t, err := NewSMTPTransport(serverAddress, from, pass)
+	if err != nil {
+		return opError("SendEmail", serverAddress, ErrInvalidConfig, err)
 	}
 
-	if port, er := strconv.Atoi(portStr); er == nil {
-
-		m := gomail.NewMessage()
-		m.SetHeader("From", from)
-		m.SetHeader("To", to...)
-		m.SetHeader("Subject", subject)
-		m.SetBody("text/html", body)
+	return SendEmailVia(t, from, subject, body, to...)
+}
 
-		d := gomail.NewDialer(host, port, from, pass)
-		d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+// SendEmailVia sends an html email through t.
+func SendEmailVia(t Transport, from string, subject, body string, to ...string) (err error) {
+	m := gomail.NewMessage()
+	m.SetHeader("From", from)
+	m.SetHeader("To", to...)
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/html", body)
 
-		if err = d.DialAndSend(m); err != nil {
-			log.Printf("Error sending Email %v", body)
-		}
-	} else {
-		err = er
-		log.Printf("Error in Email server config no port '%v' err: %v", portStr, err)
-		return
+	if err = SendMessage(t, m); err != nil {
+		return opError("SendEmail", "", ErrSend, err)
 	}
-
 	return
 }
 
-var emailRegexp = regexp.MustCompile("^(((([a-zA-Z]|\\d|[!#\\$%&'\\*\\+\\-\\/=\\?\\^_`{\\|}~]|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])+(\\.([a-zA-Z]|\\d|[!#\\$%&'\\*\\+\\-\\/=\\?\\^_`{\\|}~]|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])+)*)|((\\x22)((((\\x20|\\x09)*(\\x0d\\x0a))?(\\x20|\\x09)+)?(([\\x01-\\x08\\x0b\\x0c\\x0e-\\x1f\\x7f]|\\x21|[\\x23-\\x5b]|[\\x5d-\\x7e]|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])|(\\([\\x01-\\x09\\x0b\\x0c\\x0d-\\x7f]|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}]))))*(((\\x20|\\x09)*(\\x0d\\x0a))?(\\x20|\\x09)+)?(\\x22)))@((([a-zA-Z]|\\d|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])|(([a-zA-Z]|\\d|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])([a-zA-Z]|\\d|-|\\.|_|~|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])*([a-zA-Z]|\\d|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])))\\.)+(([a-zA-Z]|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])|(([a-zA-Z]|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])([a-zA-Z]|\\d|-|\\.|_|~|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])*([a-zA-Z]|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])))\\.?$")
-
+// IsValidEmail reports whether str is a bare address with a dotted domain,
+// see ParseAddress for the reason of a rejection. Domains must be valid host
+// names, so unlike in earlier versions "_" is not allowed in them.
 func IsValidEmail(str string) bool {
-	return emailRegexp.MatchString(str)
+	_, err := ParseAddress(str, &AddressOptions{BareOnly: true, RequireTLD: true})
+	return err == nil
 }
\ No newline at end of file
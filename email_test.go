@@ -0,0 +1,62 @@
+package util
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ekzeb/gutils/smtptest"
+)
+
+func TestSendEmailEndToEnd(t *testing.T) {
+	s, err := smtptest.NewAuthServer("from@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err = SendEmail(s.Addr(), "secret", "from@example.com", "Hello", "<p>body</p>", "to@example.com", "cc@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := s.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages", len(msgs))
+	}
+	m := msgs[0]
+	if m.From != "from@example.com" || strings.Join(m.To, ",") != "to@example.com,cc@example.org" {
+		t.Errorf("envelope %s -> %v", m.From, m.To)
+	}
+	if !m.TLS || m.Username != "from@example.com" {
+		t.Errorf("TLS=%v Username=%q", m.TLS, m.Username)
+	}
+
+	sent := SentMessage{Raw: m.Data}
+	h, err := sent.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Get("Subject"); got != "Hello" {
+		t.Errorf("Subject = %q", got)
+	}
+	if p, ok := sent.Part("text/html"); !ok || strings.TrimSpace(string(p.Body)) != "<p>body</p>" {
+		t.Errorf("html part = %q, %v", p.Body, ok)
+	}
+}
+
+func TestSendEmailWrongPassword(t *testing.T) {
+	s, err := smtptest.NewAuthServer("from@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err = SendEmail(s.Addr(), "wrong", "from@example.com", "Hello", "<p>body</p>", "to@example.com")
+	if !errors.Is(err, ErrSend) {
+		t.Errorf("got %v, want ErrSend", err)
+	}
+	if len(s.Messages()) != 0 {
+		t.Error("message accepted")
+	}
+}
@@ -1,86 +1,170 @@
 package util
 
 import (
-	"log"
-	"os"
-	"io/ioutil"
-	"encoding/json"
+	"bufio"
 	"bytes"
-	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"sort"
 )
 
+// store gob data, atomically, see WriteFileAtomic
+func StoreGob(data interface{}, filename string, fileMode os.FileMode, opts ...FileOption) error {
+	return store("StoreGob", gobCodec{}, data, filename, fileMode, newFileOptions(opts))
+}
 
-// store gob data
-func StoreGob(data interface{}, filename string, fileMode os.FileMode) (err error) {
-	buffer := new(bytes.Buffer)
-	encoder := gob.NewEncoder(buffer)
-	err = encoder.Encode(data)
+// store json data, atomically, see WriteFileAtomic
+func StoreJson(data interface{}, filename string, fileMode os.FileMode, opts ...FileOption) error {
+	return store("StoreJson", jsonCodec{}, data, filename, fileMode, newFileOptions(opts))
+}
 
-	if err != nil {
-		log.Println("Error Encode GOB data:", err)
-	}
+// load gob data, decoding while reading the file
+func LoadGob(data interface{}, filename string, opts ...FileOption) error {
+	return load("LoadGob", gobCodec{}, data, filename, newFileOptions(opts))
+}
 
-	err = ioutil.WriteFile(filename, buffer.Bytes(), fileMode)
+// load json data, decoding while reading the file
+func LoadJson(data interface{}, filename string, opts ...FileOption) error {
+	return load("LoadJson", jsonCodec{}, data, filename, newFileOptions(opts))
+}
 
-	if err != nil {
-		log.Println("Error Store GOB data:", err)
+// WithDisallowUnknownFields makes LoadJson fail on object keys which do not
+// match a struct field, e.g. misspelled config keys.
+func WithDisallowUnknownFields() FileOption {
+	return func(o *fileOptions) {
+		o.disallowUnknownFields = true
 	}
-
-	return
 }
-// store json data
-func StoreJson(data interface{}, filename string, fileMode os.FileMode) (err error)  {
-
-	b, err := json.Marshal(data)
-	if err != nil {
-		log.Println("Error Marshal JSON data:", err)
 
+// WithUseNumber makes LoadJson decode numbers into interface{} values as
+// json.Number instead of float64, keeping the precision of large numbers.
+func WithUseNumber() FileOption {
+	return func(o *fileOptions) {
+		o.useNumber = true
 	}
+}
 
-	if err := ioutil.WriteFile(filename, b, fileMode); err != nil {
-		log.Println("Error write JSON data:", err)
-
+// WithMaxSize makes loading fail with ErrTooLarge when the decoded content,
+// i.e. after decompression, exceeds n bytes. The file itself is limited to
+// about the same size before anything is decrypted or decompressed.
+func WithMaxSize(n int64) FileOption {
+	return func(o *fileOptions) {
+		o.maxSize = n
 	}
-
-	return
 }
-// load gob data
-func LoadGob(data interface{}, filename string) (err error) {
-	raw, err := ioutil.ReadFile(filename)
 
-	if err != nil {
-		log.Println(fmt.Errorf("Error Load GOB data:", err))
+// decodeJson validates and decodes r with the JSON options of o, reading the
+// whole document only when validating it against a JSON Schema. Anything but
+// whitespace after the value fails with ErrTrailingData. Syntax and type
+// errors report the line and column.
+func decodeJson(r io.Reader, data interface{}, o *fileOptions) error {
+	lr := &jsonLineReader{r: r}
+	r = lr
+	if o.jsonSchema != nil {
+		raw, err := io.ReadAll(lr)
+		if err != nil {
+			return err
+		}
+		if err = o.jsonSchema.ValidateJson(raw); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				return lr.positionError(syntaxErr.Offset-1, err)
+			}
+			return err
+		}
+		r = bytes.NewReader(raw)
+	}
+	dec := json.NewDecoder(r)
+	if o.disallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if o.useNumber {
+		dec.UseNumber()
+	}
+	if err := dec.Decode(data); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			// The offset is just past the offending character.
+			return lr.positionError(syntaxErr.Offset-1, err)
+		case errors.As(err, &typeErr):
+			return lr.positionError(typeErr.Offset, err)
+		}
+		return err
 	}
 
-	buffer := bytes.NewBuffer(raw)
+	// Skip the whitespace after the value, reading on from what the
+	// decoder has buffered.
+	offset := dec.InputOffset()
+	rest := bufio.NewReader(io.MultiReader(dec.Buffered(), r))
+	for {
+		c, err := rest.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return lr.positionError(offset, ErrTrailingData)
+		}
+		offset++
+	}
+}
 
-	dec := gob.NewDecoder(buffer)
+// jsonLineReader records where the lines of what is read from r start, to
+// report positions of errors.
+type jsonLineReader struct {
+	r        io.Reader
+	n        int64
+	newlines []int64
+}
 
-	err = dec.Decode(data)
-	if err != nil {
-		log.Println("Error Decode GOD data:", err)
+func (l *jsonLineReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	for i, c := range p[:n] {
+		if c == '\n' {
+			l.newlines = append(l.newlines, l.n+int64(i))
+		}
 	}
-
-	return
+	l.n += int64(n)
+	return n, err
 }
-// load json data
-func LoadJson(data interface{}, filename string) (err error) {
-	jsonFile, err := os.Open(filename)
-	if err != nil {
-		log.Println(fmt.Errorf("Error opening JSON file:", err))
+
+// positionError prefixes err with the 1-based line and column of offset.
+func (l *jsonLineReader) positionError(offset int64, err error) error {
+	if offset > l.n {
+		offset = l.n
+	}
+	if offset < 0 {
+		offset = 0
 	}
-	defer jsonFile.Close()
+	line := sort.Search(len(l.newlines), func(i int) bool { return l.newlines[i] >= offset })
+	column := offset + 1
+	if line > 0 {
+		column = offset - l.newlines[line-1]
+	}
+	return fmt.Errorf("line %d, column %d: %w", line+1, column, err)
+}
 
-	jsonData, err := ioutil.ReadAll(jsonFile)
+// maxSizeReader fails with ErrTooLarge once more than n bytes are read.
+type maxSizeReader struct {
+	r io.Reader
+	n int64
+}
 
-	if err != nil {
-		log.Println(fmt.Errorf("Error reading JSON data:", err))
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > m.n+1 {
+		p = p[:m.n+1]
 	}
-
-	if err := json.Unmarshal(jsonData, data); err != nil {
-		log.Println(fmt.Errorf("Error Unmarshal JSON data:", err))
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	if m.n < 0 {
+		return n, ErrTooLarge
 	}
-
-	return
+	return n, err
 }
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadJsonTrailingData(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []struct {
+		content string
+		err     error
+	}{
+		{`{"a":1}`, nil},
+		{"{\"a\":1}\n\t \n", nil},
+		{`{"a":1} garbage`, ErrTrailingData},
+		{`{"a":1} {"a":2}`, ErrTrailingData},
+		{`{"a":1}]`, ErrTrailingData},
+	} {
+		for _, ext := range []string{".json", ".data"} {
+			filename := filepath.Join(dir, "f"+ext)
+			if err := os.WriteFile(filename, []byte(c.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			var v map[string]int
+			var err error
+			if ext == ".json" {
+				err = Load(&v, filename)
+			} else {
+				err = LoadJson(&v, filename)
+			}
+			if !errors.Is(err, c.err) || (c.err == nil) != (err == nil) {
+				t.Errorf("%q%s: got %v, want %v", c.content, ext, err, c.err)
+			}
+			if c.err == nil && v["a"] != 1 {
+				t.Errorf("%q%s: got %v", c.content, ext, v)
+			}
+		}
+	}
+}
+
+func TestLoadJsonErrorPosition(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "f.json")
+	for _, c := range []struct{ content, pos string }{
+		{"{\n  \"a\": 1,\n  \"b\": x\n}", "line 3, column 8"},
+		{"{\"a\": 1}\n\n  garbage", "line 3, column 3"},
+		{"{\n\"a\": \"s\"}", "line 2, column"},
+	} {
+		os.WriteFile(filename, []byte(c.content), 0600)
+		var v map[string]int
+		err := LoadJson(&v, filename)
+		if err == nil || !strings.Contains(err.Error(), c.pos) {
+			t.Errorf("%q: got %v, want %s", c.content, err, c.pos)
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestDecodeJsonStreams(t *testing.T) {
+	input := `{"a":1} x` + strings.Repeat(" ", 1<<20)
+	r := &countingReader{r: strings.NewReader(input)}
+	var v map[string]int
+	if err := decodeJson(r, &v, &fileOptions{}); !errors.Is(err, ErrTrailingData) {
+		t.Fatalf("got %v, want ErrTrailingData", err)
+	}
+	if r.n >= len(input) {
+		t.Errorf("read all %d bytes", r.n)
+	}
+}
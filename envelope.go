@@ -0,0 +1,390 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Compression algorithms for WithCompression.
+type Compression byte
+
+const (
+	NoCompression Compression = iota
+	CompressGzip
+	CompressZstd
+)
+
+// Cipher algorithms for WithEncryption. Both take 32 byte keys.
+type Cipher byte
+
+const (
+	NoEncryption Cipher = iota
+	CipherAESGCM
+	CipherXChaCha20Poly1305
+)
+
+// KeyProvider supplies encryption keys. The id of the key used is stored
+// in the file header, so keys can be rotated while old files stay readable.
+type KeyProvider interface {
+	// CurrentKey returns the key for new files and its id.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given id.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKey is a KeyProvider of a single key with an empty id.
+type StaticKey []byte
+
+func (k StaticKey) CurrentKey() (string, []byte, error) {
+	return "", k, nil
+}
+
+func (k StaticKey) Key(id string) ([]byte, error) {
+	if id != "" {
+		return nil, fmt.Errorf("%w: unknown key id %q", ErrNoKey, id)
+	}
+	return k, nil
+}
+
+// KeyRing is a KeyProvider of several keys, Current naming the one used for
+// new files.
+type KeyRing struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (r *KeyRing) CurrentKey() (string, []byte, error) {
+	key, err := r.Key(r.Current)
+	return r.Current, key, err
+}
+
+func (r *KeyRing) Key(id string) ([]byte, error) {
+	key, ok := r.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key id %q", ErrNoKey, id)
+	}
+	return key, nil
+}
+
+// WithCompression compresses stored files.
+func WithCompression(c Compression) FileOption {
+	return func(o *fileOptions) {
+		o.compression = c
+	}
+}
+
+// WithEncryption encrypts stored files with the current key of keys. Loading
+// needs the same keys, see WithKeys.
+func WithEncryption(c Cipher, keys KeyProvider) FileOption {
+	return func(o *fileOptions) {
+		o.cipher, o.keys = c, keys
+	}
+}
+
+// WithKeys supplies the keys to load encrypted files with. Loading then
+// fails with ErrDecrypt for files that are not encrypted, so that whoever can
+// write the file cannot replace it with forged plaintext, unless
+// WithPlaintextFallback is given too.
+func WithKeys(keys KeyProvider) FileOption {
+	return func(o *fileOptions) {
+		o.keys = keys
+	}
+}
+
+// WithPlaintextFallback lets loading with keys accept files that are not
+// encrypted, e.g. while migrating plain files to encrypted ones.
+func WithPlaintextFallback() FileOption {
+	return func(o *fileOptions) {
+		o.plaintext = true
+	}
+}
+
+// Compressed, encrypted and versioned files start with a header:
+//
+//	magic        4 bytes "\x89GUT"
+//	version      1 byte
+//	compression  1 byte
+//	cipher       1 byte
+//	codec        1 byte length, name
+//	key id       1 byte length, id
+//	schema       1 byte length, name (since version 2)
+//	schema ver   4 bytes big endian (since version 2)
+//
+// followed by the payload, for encrypted files the nonce and the sealed
+// payload, which authenticates the header too. Files without the magic are
+// plain encoded data.
+var fileMagic = []byte("\x89GUT")
+
+const fileHeaderVersion = 2
+
+type fileHeader struct {
+	compression   Compression
+	cipher        Cipher
+	codec         string
+	keyID         string
+	schema        string
+	schemaVersion int
+}
+
+func (h *fileHeader) marshal() ([]byte, error) {
+	b := append([]byte{}, fileMagic...)
+	b = append(b, fileHeaderVersion, byte(h.compression), byte(h.cipher))
+	for _, s := range []string{h.codec, h.keyID, h.schema} {
+		if len(s) > 255 {
+			return nil, fmt.Errorf("header field %q too long", s)
+		}
+		b = append(append(b, byte(len(s))), s...)
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(h.schemaVersion)), nil
+}
+
+// readFileHeader parses the header and returns it with its raw bytes.
+func readFileHeader(r *bufio.Reader) (*fileHeader, []byte, error) {
+	raw := make([]byte, len(fileMagic)+3)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, nil, fmt.Errorf("truncated header: %w", err)
+	}
+	version := raw[len(fileMagic)]
+	if version < 1 || version > fileHeaderVersion {
+		return nil, nil, fmt.Errorf("unsupported header version %d", version)
+	}
+	h := &fileHeader{
+		compression: Compression(raw[len(fileMagic)+1]),
+		cipher:      Cipher(raw[len(fileMagic)+2]),
+	}
+	fields := []*string{&h.codec, &h.keyID}
+	if version >= 2 {
+		fields = append(fields, &h.schema)
+	}
+	for _, s := range fields {
+		n, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("truncated header: %w", err)
+		}
+		field := make([]byte, n)
+		if _, err = io.ReadFull(r, field); err != nil {
+			return nil, nil, fmt.Errorf("truncated header: %w", err)
+		}
+		*s = string(field)
+		raw = append(append(raw, n), field...)
+	}
+	if version >= 2 {
+		var v [4]byte
+		if _, err := io.ReadFull(r, v[:]); err != nil {
+			return nil, nil, fmt.Errorf("truncated header: %w", err)
+		}
+		h.schemaVersion = int(binary.BigEndian.Uint32(v[:]))
+		raw = append(raw, v[:]...)
+	}
+	return h, raw, nil
+}
+
+// encodeFile encodes data with c, adding the header, compression and
+// encryption requested by o.
+func encodeFile(c Codec, data interface{}, o *fileOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	if o.compression == NoCompression && o.cipher == NoEncryption && o.schema == "" {
+		err := c.Encode(&buf, data)
+		return buf.Bytes(), err
+	}
+
+	h := &fileHeader{compression: o.compression, cipher: o.cipher, codec: c.Name(), schema: o.schema}
+	if o.schema != "" {
+		var err error
+		if h.schemaVersion, err = currentSchemaVersion(o.schema); err != nil {
+			return nil, err
+		}
+	}
+	var key []byte
+	if o.cipher != NoEncryption {
+		if o.keys == nil {
+			return nil, fmt.Errorf("%w: no key provider", ErrNoKey)
+		}
+		var err error
+		if h.keyID, key, err = o.keys.CurrentKey(); err != nil {
+			return nil, err
+		}
+	}
+	header, err := h.marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := compressWriter(&buf, o.compression)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Encode(w, data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	if o.cipher == NoEncryption {
+		return append(header, buf.Bytes()...), nil
+	}
+
+	aead, err := newAEAD(o.cipher, key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte{}, header...), nonce...)
+	return aead.Seal(out, nonce, buf.Bytes(), header), nil
+}
+
+// decodeFile decodes r into data with c, detecting the header. It returns the
+// header, nil for plain files, and whether data was upgraded from an older
+// schema version.
+func decodeFile(c Codec, r io.Reader, data interface{}, o *fileOptions) (*fileHeader, bool, error) {
+	if o.maxSize > 0 {
+		// Bound the file itself too, leaving room for the header, nonce,
+		// tag and compression framing around content of maxSize bytes.
+		r = &maxSizeReader{r: r, n: o.maxSize + o.maxSize>>12 + 1024}
+	}
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(fileMagic)); !bytes.Equal(magic, fileMagic) {
+		if o.keys != nil && !o.plaintext {
+			return nil, false, fmt.Errorf("%w: file is not encrypted", ErrDecrypt)
+		}
+		upgraded, err := decodeSchema(c, br, data, nil, o)
+		return nil, upgraded, err
+	}
+
+	h, header, err := readFileHeader(br)
+	if err != nil {
+		return nil, false, err
+	}
+	if h.codec != c.Name() {
+		return h, false, fmt.Errorf("%w: file holds %q, not %q", ErrUnknownCodec, h.codec, c.Name())
+	}
+
+	var payload io.Reader = br
+	if h.cipher == NoEncryption {
+		if o.keys != nil && !o.plaintext {
+			return h, false, fmt.Errorf("%w: file is not encrypted", ErrDecrypt)
+		}
+	} else {
+		if o.keys == nil {
+			return h, false, fmt.Errorf("%w: file is encrypted", ErrNoKey)
+		}
+		key, err := o.keys.Key(h.keyID)
+		if err != nil {
+			return h, false, err
+		}
+		aead, err := newAEAD(h.cipher, key)
+		if err != nil {
+			return h, false, err
+		}
+		sealed, err := io.ReadAll(br)
+		if err != nil {
+			return h, false, err
+		}
+		if len(sealed) < aead.NonceSize() {
+			return h, false, fmt.Errorf("%w: truncated", ErrDecrypt)
+		}
+		plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], header)
+		if err != nil {
+			return h, false, fmt.Errorf("%w: %v", ErrDecrypt, err)
+		}
+		payload = bytes.NewReader(plain)
+	}
+
+	dr, err := decompressReader(payload, h.compression)
+	if err != nil {
+		return h, false, err
+	}
+	defer dr.Close()
+	upgraded, err := decodeSchema(c, dr, data, h, o)
+	return h, upgraded, err
+}
+
+// decodeSchema decodes r into data, upgrading it when o asks for a schema.
+func decodeSchema(c Codec, r io.Reader, data interface{}, h *fileHeader, o *fileOptions) (bool, error) {
+	if o.maxSize > 0 {
+		r = &maxSizeReader{r: r, n: o.maxSize}
+	}
+	if _, ok := c.(jsonCodec); ok {
+		c = strictJsonCodec{o}
+	}
+	if o.schema == "" {
+		return false, c.Decode(r, data)
+	}
+	version := 0
+	if h != nil && h.schema != "" {
+		if h.schema != o.schema {
+			return false, fmt.Errorf("%w: file holds %q, not %q", ErrSchema, h.schema, o.schema)
+		}
+		version = h.schemaVersion
+	}
+	return decodeVersion(o.schema, version, func(v interface{}) error {
+		return c.Decode(r, v)
+	}, data)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func compressWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case NoCompression:
+		return nopWriteCloser{w}, nil
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %d", c)
+}
+
+func decompressReader(r io.Reader, c Compression) (io.ReadCloser, error) {
+	switch c {
+	case NoCompression:
+		return io.NopCloser(r), nil
+	case CompressGzip:
+		return gzip.NewReader(r)
+	case CompressZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression %d", c)
+}
+
+func newAEAD(c Cipher, key []byte) (cipher.AEAD, error) {
+	switch c {
+	case CipherAESGCM:
+		if len(key) != 32 {
+			return nil, fmt.Errorf("%w: AES-GCM needs a 32 byte key", ErrNoKey)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherXChaCha20Poly1305:
+		if len(key) != chacha20poly1305.KeySize {
+			return nil, fmt.Errorf("%w: XChaCha20-Poly1305 needs a 32 byte key", ErrNoKey)
+		}
+		return chacha20poly1305.NewX(key)
+	}
+	return nil, fmt.Errorf("unknown cipher %d", c)
+}
@@ -0,0 +1,89 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStoreLoadEnvelope(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "f.gob")
+	key := StaticKey(bytes.Repeat([]byte{7}, 32))
+	data := map[string]string{}
+	for i := 0; i < 100; i++ {
+		data[strings.Repeat("k", i)] = "value"
+	}
+	for _, c := range []Compression{NoCompression, CompressGzip, CompressZstd} {
+		for _, ci := range []Cipher{CipherAESGCM, CipherXChaCha20Poly1305} {
+			if err := StoreGob(data, filename, 0600, WithCompression(c), WithEncryption(ci, key)); err != nil {
+				t.Fatal(err)
+			}
+			var out map[string]string
+			if err := LoadGob(&out, filename, WithKeys(key)); err != nil || len(out) != len(data) {
+				t.Fatalf("%d/%d: %v", c, ci, err)
+			}
+			if err := LoadGob(&out, filename); !errors.Is(err, ErrNoKey) {
+				t.Errorf("%d/%d without keys: %v", c, ci, err)
+			}
+			b, _ := os.ReadFile(filename)
+			b[len(b)-1] ^= 1
+			os.WriteFile(filename, b, 0600)
+			if err := LoadGob(&out, filename, WithKeys(key)); !errors.Is(err, ErrDecrypt) {
+				t.Errorf("%d/%d tampered: %v", c, ci, err)
+			}
+		}
+	}
+}
+
+func TestLoadWithKeysRejectsPlaintext(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "f.json")
+	key := StaticKey(bytes.Repeat([]byte{7}, 32))
+	for _, opts := range [][]FileOption{
+		nil,
+		{WithCompression(CompressGzip)},
+	} {
+		if err := StoreJson(map[string]int{"a": 666}, filename, 0600, opts...); err != nil {
+			t.Fatal(err)
+		}
+		var v map[string]int
+		if err := LoadJson(&v, filename, WithKeys(key)); !errors.Is(err, ErrDecrypt) || v != nil {
+			t.Errorf("got %v, %v, want ErrDecrypt", v, err)
+		}
+		if err := LoadJson(&v, filename, WithKeys(key), WithPlaintextFallback()); err != nil || v["a"] != 666 {
+			t.Errorf("fallback: got %v, %v", v, err)
+		}
+	}
+}
+
+func TestLoadRejectsHeaderCodecMismatch(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "f.json")
+	if err := StoreJson([]int{1}, filename, 0600, WithCompression(CompressGzip)); err != nil {
+		t.Fatal(err)
+	}
+	var v []int
+	if err := Load(&v, filename, WithCodec("gob")); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("got %v, want ErrUnknownCodec", err)
+	}
+	if err := Load(&v, filename); err != nil || len(v) != 1 {
+		t.Errorf("got %v, %v", v, err)
+	}
+}
+
+func TestLoadMaxSizeLimitsSealedPayload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "f.json")
+	key := StaticKey(bytes.Repeat([]byte{7}, 32))
+	data := strings.Repeat("x", 1<<20)
+	if err := StoreJson(data, filename, 0600, WithEncryption(CipherAESGCM, key)); err != nil {
+		t.Fatal(err)
+	}
+	var v string
+	if err := LoadJson(&v, filename, WithKeys(key), WithMaxSize(4096)); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+	if err := LoadJson(&v, filename, WithKeys(key), WithMaxSize(1<<20+3)); err != nil || v != data {
+		t.Errorf("got %d bytes, %v", len(v), err)
+	}
+}
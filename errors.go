@@ -0,0 +1,92 @@
+package util
+
+import (
+	"errors"
+	"log/slog"
+	"sync/atomic"
+)
+
+// Sentinel errors, match them with errors.Is. The underlying cause, e.g.
+// fs.ErrNotExist or a *json.SyntaxError, stays reachable as well.
+var (
+	ErrEncode            = errors.New("encode failed")
+	ErrDecode            = errors.New("decode failed")
+	ErrRead              = errors.New("read failed")
+	ErrWrite             = errors.New("write failed")
+	ErrNotDirectory      = errors.New("not a directory")
+	ErrDestinationExists = errors.New("destination already exists")
+	ErrInvalidNumber     = errors.New("invalid number")
+	ErrInvalidConfig     = errors.New("invalid configuration")
+	ErrInvalidMessage    = errors.New("invalid message")
+	ErrTemplate          = errors.New("template failed")
+	ErrSend              = errors.New("send failed")
+	ErrCommand           = errors.New("command failed")
+	ErrUnknownCodec      = errors.New("no codec for file")
+	ErrNoKey             = errors.New("no encryption key")
+	ErrDecrypt           = errors.New("decryption failed")
+	ErrSchema            = errors.New("schema mismatch")
+	ErrTooLarge          = errors.New("content too large")
+	ErrTrailingData      = errors.New("trailing data after value")
+	ErrValidation        = errors.New("validation failed")
+	// ErrNotFound is returned by KV.Get for missing keys.
+	ErrNotFound = errors.New("key not found")
+	// ErrLocked is returned by OpenKV when another process has the store open.
+	ErrLocked = errors.New("store is locked")
+	// ErrClosed is returned by the methods of a closed KV.
+	ErrClosed = errors.New("store is closed")
+)
+
+// OpError records the operation and the file, directory or address it
+// failed on.
+type OpError struct {
+	// Op is the exported function that failed, e.g. "LoadJson".
+	Op string
+	// Path may be empty.
+	Path string
+	// Kind is one of the Err* sentinels.
+	Kind error
+	// Err is the underlying error, may be nil.
+	Err error
+}
+
+func (e *OpError) Error() string {
+	s := e.Op
+	if e.Path != "" {
+		s += " " + e.Path
+	}
+	s += ": " + e.Kind.Error()
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+// Unwrap returns both the kind and the underlying error.
+func (e *OpError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+var logger atomic.Pointer[slog.Logger]
+
+// SetLogger makes the package log failures to l, which it does not do by
+// default. A nil l turns logging off again.
+func SetLogger(l *slog.Logger) {
+	logger.Store(l)
+}
+
+// opError builds an *OpError and logs it.
+func opError(op, path string, kind, err error) error {
+	e := &OpError{Op: op, Path: path, Kind: kind, Err: err}
+	logError(e)
+	return e
+}
+
+// logError logs err unless logging is off or err is nil.
+func logError(err error, args ...any) {
+	if l := logger.Load(); l != nil && err != nil {
+		l.Error(err.Error(), args...)
+	}
+}
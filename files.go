@@ -1,15 +1,14 @@
 package util
 
 import (
-	"io/ioutil"
+	"bytes"
+	"context"
 	"os"
-	"log"
-	"errors"
-	"io"
 	"path/filepath"
 	"sort"
 	"os/exec"
 	"fmt"
+	"strings"
 )
 
 const (
@@ -33,125 +32,51 @@ func SortFilesByModTime(files []os.FileInfo, asc bool) {
 func RemoveDirRecursively(dir string) error {
 	d, err := os.Open(dir)
 	if err != nil {
-		return err
+		return opError("RemoveDirRecursively", dir, ErrRead, err)
 	}
 	defer d.Close()
 
 	fi,err := d.Stat()
 	if err != nil {
-		return err
+		return opError("RemoveDirRecursively", dir, ErrRead, err)
 	}
 	if !fi.IsDir() {
-		return errors.New(fmt.Sprintf("%v not directory", dir))
+		return opError("RemoveDirRecursively", dir, ErrNotDirectory, nil)
 	}
 
 	names, err := d.Readdirnames(-1)
 	if err != nil {
-		return err
+		return opError("RemoveDirRecursively", dir, ErrRead, err)
 	}
 	for _, name := range names {
 		err = os.RemoveAll(filepath.Join(dir, name))
 		if err != nil {
-			return err
+			return opError("RemoveDirRecursively", dir, ErrWrite, err)
 		}
 	}
 	return nil
 }
 
-//copy file with rights
+// CopyFile copies the file source to dest with its permissions. See
+// CopyFileWithOptions to keep more metadata.
 func CopyFile(source string, dest string) (err error) {
-	sf, err := os.Open(source)
-	if err != nil {
-		return err
-	}
-	defer sf.Close()
-	df, err := os.Create(dest)
-	if err != nil {
-		return err
-	}
-	defer df.Close()
-	_, err = io.Copy(df, sf)
-	if err == nil {
-		si, err := os.Stat(source)
-		if err != nil {
-			err = os.Chmod(dest, si.Mode())
-		}
-
-	}
-
-	return
+	return CopyFileWithOptions(context.Background(), source, dest, PreserveMode)
 }
 
+// CopyDir copies the directory tree source to dest, which must not exist,
+// following symbolic links and keeping permissions. See CopyDirWithOptions.
 func CopyDir(source string, dest string, excludes ...func(os.FileInfo) bool) (err error) {
-
-	// get properties of source dir
-	fi, err := os.Stat(source)
-	if err != nil {
-		return err
-	}
-
-	if !fi.IsDir() {
-		return errors.New("Source is not a directory")
-	}
-
-	// ensure dest dir does not already exist
-
-	_, err = os.Open(dest)
-	if !os.IsNotExist(err) {
-		return errors.New("Destination already exists")
-	}
-
-	// create dest dir
-
-	err = os.MkdirAll(dest, fi.Mode())
-	if err != nil {
-		return err
-	}
-
-	entries, err := ioutil.ReadDir(source)
-
-	filterExcluded := func(f os.FileInfo) (result bool){
-		for _,pred := range excludes {
-			if pred(f) {
-				result = true
-				break
-			}
-		}
-		return
-	}
-
-	for _, entry := range entries {
-
-		if filterExcluded(entry) {
-			continue
-		}
-
-		sfp := source + "/" + entry.Name()
-		dfp := dest + "/" + entry.Name()
-
-		if entry.IsDir() {
-			err = CopyDir(sfp, dfp, excludes...)
-			if err != nil {
-				log.Println(err)
-			}
-		} else {
-			// perform copy
-			err = CopyFile(sfp, dfp)
-			if err != nil {
-				log.Println(err)
-			}
-		}
-
-	}
-	return
+	return CopyDirWithOptions(context.Background(), source, dest, &CopyOptions{Excludes: excludes, Preserve: PreserveMode})
 }
 
 func MakeDirIfNotExists(dir string, fileMode os.FileMode) (err error) {
 	if _, er := os.Stat(dir); er != nil {
 		if os.IsNotExist(er) {
-			err = os.Mkdir(dir, fileMode)
+			if er = os.Mkdir(dir, fileMode); er != nil {
+				err = opError("MakeDirIfNotExists", dir, ErrWrite, er)
+			}
 		} else {
-			log.Println(err)
+			err = opError("MakeDirIfNotExists", dir, ErrRead, er)
 		}
 	}
 	return
@@ -166,19 +91,46 @@ func FileExists(filename string) (exists bool) {
 
 func RsyncSSH(src, dest string, delete bool, excludes ...string) (err error) {
 
+	var params []string
+	for _, param := range excludes {
+		params = append(params, fmt.Sprintf("--exclude %v", param))
+	}
+	return rsyncSSH(src, dest, delete, params)
+}
+
+// RsyncSSHWithFilter is RsyncSSH excluding the paths filter excludes, see
+// PathFilter.RsyncArgs.
+func RsyncSSHWithFilter(src, dest string, delete bool, filter *PathFilter) (err error) {
+
+	var params []string
+	for _, arg := range filter.RsyncArgs() {
+		params = append(params, "'" + strings.Replace(arg, "'", `'\''`, -1) + "'")
+	}
+	return rsyncSSH(src, dest, delete, params)
+}
+
+// rsyncSSH runs rsync with params, which are put into the command line as is.
+func rsyncSSH(src, dest string, delete bool, params []string) (err error) {
+
 	command := "rsync -avz -e 'ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null' "
 
 	if delete {
 		command += "--delete "
 	}
 
-	if len(excludes) > 0 {
-		for _, param := range excludes {
-			command += fmt.Sprintf("--exclude %v ", param)
-		}
+	for _, param := range params {
+		command += param + " "
 	}
 
 	cmd := exec.Command("bash", "-c", fmt.Sprintf("%v %v %v", command, src, dest))
-	err = cmd.Run()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return opError("RsyncSSH", dest, ErrCommand, err)
+	}
 	return
 }
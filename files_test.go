@@ -0,0 +1,43 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMakeDirIfNotExists(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "d")
+	if err := MakeDirIfNotExists(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := MakeDirIfNotExists(dir, 0755); err != nil {
+		t.Errorf("existing directory: %v", err)
+	}
+
+	err := MakeDirIfNotExists(filepath.Join(dir, "missing", "d"), 0755)
+	var oe *OpError
+	if !errors.As(err, &oe) || !errors.Is(err, ErrWrite) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want *OpError wrapping ErrWrite and ErrNotExist", err)
+	}
+}
+
+func TestRemoveDirRecursively(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "a", "b"), 0755)
+	os.WriteFile(filepath.Join(dir, "a", "b", "f"), nil, 0644)
+	os.WriteFile(filepath.Join(dir, "g"), nil, 0644)
+
+	if err := RemoveDirRecursively(dir); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d entries left", len(entries))
+	}
+
+	err := RemoveDirRecursively(filepath.Join(dir, "missing"))
+	if !errors.Is(err, ErrRead) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want ErrRead wrapping ErrNotExist", err)
+	}
+}
@@ -0,0 +1,282 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// PathFilter excludes paths by .gitignore patterns:
+//
+//	# comment, blank lines are ignored
+//	*.log      any file or directory named so, at any depth
+//	/build     build at the root only; a slash anywhere but at the end anchors too
+//	tmp/       directories only
+//	**/cache   cache at any depth, a/**/b with zero or more directories between
+//	logs/**    everything below logs
+//	!keep.log  re-includes what earlier patterns excluded
+//
+// The last matching pattern decides. As in git, nothing below an excluded
+// directory can be re-included. Paths are relative to the root of the
+// operation and slash separated, os.PathSeparator is accepted as well.
+//
+// A nil *PathFilter excludes nothing.
+type PathFilter struct {
+	rules []pathRule
+}
+
+type pathRule struct {
+	// glob is the pattern without "!", and the leading and trailing slash.
+	glob     string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	re       *regexp.Regexp
+}
+
+// NewPathFilter compiles .gitignore patterns.
+func NewPathFilter(patterns ...string) (*PathFilter, error) {
+	return newPathFilter(patterns, false)
+}
+
+// NewDockerignoreFilter compiles .dockerignore patterns, which differ from
+// .gitignore ones in being relative to the root: "*.log" only matches at the
+// top, "**/*.log" at any depth.
+func NewDockerignoreFilter(patterns ...string) (*PathFilter, error) {
+	return newPathFilter(patterns, true)
+}
+
+// ParsePathFilter reads .gitignore patterns, one per line.
+func ParsePathFilter(r io.Reader) (*PathFilter, error) {
+	lines, err := readPatternLines(r)
+	if err != nil {
+		return nil, err
+	}
+	return NewPathFilter(lines...)
+}
+
+// LoadPathFilter reads the patterns in filename, as .dockerignore patterns
+// if it is named .dockerignore and as .gitignore patterns otherwise.
+func LoadPathFilter(filename string) (*PathFilter, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, opError("LoadPathFilter", filename, ErrRead, err)
+	}
+	defer f.Close()
+	lines, err := readPatternLines(f)
+	if err != nil {
+		return nil, opError("LoadPathFilter", filename, ErrRead, err)
+	}
+	pf, err := newPathFilter(lines, filepath.Base(filename) == ".dockerignore")
+	if err != nil {
+		return nil, opError("LoadPathFilter", filename, ErrDecode, err)
+	}
+	return pf, nil
+}
+
+func readPatternLines(r io.Reader) ([]string, error) {
+	var lines []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	return lines, s.Err()
+}
+
+func newPathFilter(patterns []string, anchored bool) (*PathFilter, error) {
+	f := &PathFilter{}
+	for _, p := range patterns {
+		r, ok, err := parsePathRule(p, anchored)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %v", p, err)
+		}
+		if ok {
+			f.rules = append(f.rules, r)
+		}
+	}
+	return f, nil
+}
+
+// parsePathRule parses a pattern line; ok is false for blanks and comments.
+func parsePathRule(p string, anchored bool) (r pathRule, ok bool, err error) {
+	p = strings.TrimRight(p, "\r")
+	// Trailing spaces are ignored unless escaped.
+	for strings.HasSuffix(p, " ") && !strings.HasSuffix(p, `\ `) {
+		p = p[:len(p)-1]
+	}
+	if p == "" || p[0] == '#' {
+		return r, false, nil
+	}
+	if p[0] == '!' {
+		r.negate = true
+		p = p[1:]
+	} else if p[0] == '\\' && len(p) > 1 && (p[1] == '!' || p[1] == '#') {
+		p = p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if strings.HasPrefix(p, "/") {
+		anchored = true
+		p = strings.TrimLeft(p, "/")
+	}
+	if p == "" {
+		return r, false, nil
+	}
+	r.glob = p
+	r.anchored = anchored || strings.Contains(p, "/")
+
+	expr, err := globRegexp(p)
+	if err != nil {
+		return r, false, err
+	}
+	if !r.anchored {
+		expr = "(?:.*/)?" + expr
+	}
+	if r.re, err = regexp.Compile("^" + expr + "$"); err != nil {
+		return r, false, err
+	}
+	return r, true, nil
+}
+
+// globRegexp translates a glob with ** to a regular expression.
+func globRegexp(glob string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			atStart := i == 0 || glob[i-1] == '/'
+			rest := glob[i+2:]
+			switch {
+			case atStart && rest == "":
+				b.WriteString(".*")
+			case atStart && rest[0] == '/':
+				// Zero or more directories.
+				b.WriteString("(?:.*/)?")
+				i++
+			default:
+				b.WriteString("[^/]*")
+			}
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated [")
+			}
+			class := glob[i+1 : i+1+end]
+			if end == 0 {
+				// "[]...]" has ] as its first member.
+				if end = strings.IndexByte(glob[i+2:], ']'); end < 0 {
+					return "", fmt.Errorf("unterminated [")
+				}
+				end++
+				class = glob[i+1 : i+1+end]
+			}
+			if class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String(), nil
+}
+
+// Match reports whether the path, a directory if isDir, is excluded, either
+// itself or by an excluded parent directory.
+func (f *PathFilter) Match(name string, isDir bool) bool {
+	if f == nil || len(f.rules) == 0 {
+		return false
+	}
+	name = path.Clean(filepath.ToSlash(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' && f.match(name[:i], true) {
+			return true
+		}
+	}
+	return f.match(name, isDir)
+}
+
+// match applies the rules to name alone.
+func (f *PathFilter) match(name string, isDir bool) (excluded bool) {
+	for _, r := range f.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(name) {
+			excluded = !r.negate
+		}
+	}
+	return
+}
+
+// WalkDir walks the tree root like filepath.WalkDir, leaving out excluded
+// entries and not descending into excluded directories. The root itself is
+// always visited.
+func (f *PathFilter) WalkDir(root string, fn fs.WalkDirFunc) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if p != root && d != nil {
+			rel, er := filepath.Rel(root, p)
+			if er == nil && f != nil && f.match(filepath.ToSlash(rel), d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		return fn(p, d, err)
+	})
+}
+
+// RsyncArgs translates the patterns to rsync --filter arguments, which
+// are not shell quoted. rsync's "a/**/b" needs at least one directory
+// between a and b.
+//
+// Anchored rules are relative to the rsync transfer root, which is the
+// source directory itself for "src/" but its parent for "src". Pass the
+// source with a trailing slash for paths to be matched as by Match.
+func (f *PathFilter) RsyncArgs() []string {
+	if f == nil {
+		return nil
+	}
+	// rsync stops at the first matching rule, git at the last.
+	args := make([]string, 0, len(f.rules))
+	for i := len(f.rules) - 1; i >= 0; i-- {
+		r := f.rules[i]
+		rule := "- "
+		if r.negate {
+			rule = "+ "
+		}
+		// rsync matches patterns with a slash at any depth unless anchored
+		// by a leading one.
+		if glob := strings.TrimPrefix(r.glob, "**/"); glob != r.glob {
+			rule += glob
+		} else if r.anchored {
+			rule += "/" + r.glob
+		} else {
+			rule += r.glob
+		}
+		if r.dirOnly {
+			rule += "/"
+		}
+		args = append(args, "--filter="+rule)
+	}
+	return args
+}
@@ -0,0 +1,98 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPathFilterMatch(t *testing.T) {
+	for _, tc := range []struct {
+		patterns []string
+		docker   bool
+		name     string
+		isDir    bool
+		want     bool
+	}{
+		{[]string{"*.log"}, false, "a.log", false, true},
+		{[]string{"*.log"}, false, "x/y/a.log", false, true},
+		{[]string{"*.log"}, false, "a.logx", false, false},
+		{[]string{"# *.log", ""}, false, "a.log", false, false},
+
+		// Leading slash and a slash in the pattern anchor at the root.
+		{[]string{"/build"}, false, "build", true, true},
+		{[]string{"/build"}, false, "x/build", true, false},
+		{[]string{"doc/*.txt"}, false, "doc/a.txt", false, true},
+		{[]string{"doc/*.txt"}, false, "x/doc/a.txt", false, false},
+		{[]string{"doc/*.txt"}, false, "doc/sub/a.txt", false, false},
+
+		// Directories only, and what is below them.
+		{[]string{"tmp/"}, false, "tmp", true, true},
+		{[]string{"tmp/"}, false, "tmp", false, false},
+		{[]string{"tmp/"}, false, "x/tmp", true, true},
+		{[]string{"tmp/"}, false, "x/tmp/f", false, true},
+
+		// ** leading, in the middle and trailing.
+		{[]string{"**/cache"}, false, "cache", true, true},
+		{[]string{"**/cache"}, false, "a/b/cache", false, true},
+		{[]string{"a/**/b"}, false, "a/b", false, true},
+		{[]string{"a/**/b"}, false, "a/x/y/b", false, true},
+		{[]string{"a/**/b"}, false, "x/a/b", false, false},
+		{[]string{"logs/**"}, false, "logs/x/y", false, true},
+		{[]string{"logs/**"}, false, "logs", true, false},
+		{[]string{"a**b"}, false, "axxb", false, true},
+		{[]string{"a**b"}, false, "ax/xb", false, false},
+
+		// Negation, where the last matching pattern decides.
+		{[]string{"*.log", "!keep.log"}, false, "keep.log", false, false},
+		{[]string{"*.log", "!keep.log"}, false, "x/a.log", false, true},
+		{[]string{"!a", "a"}, false, "a", false, true},
+		{[]string{`\!a`}, false, "!a", false, true},
+		{[]string{"build/", "!build/keep"}, false, "build/keep", false, true},
+
+		// .dockerignore patterns are relative to the root.
+		{[]string{"*.log"}, true, "a.log", false, true},
+		{[]string{"*.log"}, true, "x/a.log", false, false},
+		{[]string{"**/*.log"}, true, "x/a.log", false, true},
+		{[]string{"tmp/"}, true, "x/tmp", true, false},
+	} {
+		var f *PathFilter
+		var err error
+		if tc.docker {
+			f, err = NewDockerignoreFilter(tc.patterns...)
+		} else {
+			f, err = NewPathFilter(tc.patterns...)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Match(tc.name, tc.isDir); got != tc.want {
+			t.Errorf("%q (docker %v) on %s (dir %v): got %v", tc.patterns, tc.docker, tc.name, tc.isDir, got)
+		}
+	}
+
+	if (*PathFilter)(nil).Match("a", false) {
+		t.Error("nil filter excluded")
+	}
+	if _, err := NewPathFilter("a[b"); err == nil {
+		t.Error("unterminated [ compiled")
+	}
+}
+
+func TestPathFilterRsyncArgs(t *testing.T) {
+	f, err := NewPathFilter("*.log", "/build", "doc/*.txt", "tmp/", "**/cache", "!keep.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In reverse, as rsync stops at the first matching rule.
+	want := []string{
+		"--filter=+ keep.log",
+		"--filter=- cache",
+		"--filter=- tmp/",
+		"--filter=- /doc/*.txt",
+		"--filter=- /build",
+		"--filter=- *.log",
+	}
+	if got := f.RsyncArgs(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix && !windows
+
+package util
+
+import (
+	"os"
+)
+
+// lockFile does nothing where file locks are not available.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
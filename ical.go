@@ -0,0 +1,276 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/gomail.v2"
+)
+
+// iTIP methods, see RFC 5546.
+const (
+	CalendarPublish = "PUBLISH"
+	CalendarRequest = "REQUEST"
+	CalendarCancel  = "CANCEL"
+)
+
+// DefaultCalendarProdID is used when CalendarEvent.ProdID is empty.
+const DefaultCalendarProdID = "-//ekzeb//gutils//EN"
+
+// CalendarPerson is an organizer or attendee of a CalendarEvent.
+type CalendarPerson struct {
+	Name  string
+	Email string
+	// Role defaults to REQ-PARTICIPANT, PartStat to NEEDS-ACTION. Both are
+	// only used for attendees.
+	Role     string
+	PartStat string
+	// RSVP asks the attendee to reply.
+	RSVP bool
+}
+
+// CalendarEvent is a single VEVENT.
+type CalendarEvent struct {
+	// UID must stay the same across updates and the cancellation of an event.
+	UID string
+	// Sequence must be incremented with every update.
+	Sequence int
+	// Method defaults to CalendarRequest.
+	Method string
+
+	Summary     string
+	Description string
+	Location    string
+	// Start and End are written in their time.Location, with a VTIMEZONE.
+	// UTC and time.Local are written in UTC.
+	Start time.Time
+	End   time.Time
+
+	Organizer CalendarPerson
+	Attendees []CalendarPerson
+
+	// Stamp defaults to now.
+	Stamp  time.Time
+	ProdID string
+}
+
+func (e *CalendarEvent) method() string {
+	if e.Method == "" {
+		return CalendarRequest
+	}
+	return e.Method
+}
+
+// ICS renders the event as an RFC 5545 VCALENDAR.
+func (e *CalendarEvent) ICS() ([]byte, error) {
+	if e.UID == "" {
+		return nil, errors.New("calendar event has no UID")
+	}
+	if e.End.Before(e.Start) {
+		return nil, errors.New("calendar event ends before it starts")
+	}
+
+	w := &icsWriter{}
+	prodID := e.ProdID
+	if prodID == "" {
+		prodID = DefaultCalendarProdID
+	}
+	stamp := e.Stamp
+	if stamp.IsZero() {
+		stamp = time.Now()
+	}
+
+	w.line("BEGIN:VCALENDAR")
+	w.line("VERSION:2.0")
+	w.line("PRODID:" + prodID)
+	w.line("CALSCALE:GREGORIAN")
+	w.line("METHOD:" + e.method())
+
+	loc := icsLocation(e.Start)
+	if loc != nil {
+		writeVTimezone(w, loc, e.Start, e.End)
+	}
+
+	w.line("BEGIN:VEVENT")
+	w.line("UID:" + icsText(e.UID))
+	w.line(fmt.Sprintf("SEQUENCE:%d", e.Sequence))
+	w.line("DTSTAMP:" + stamp.UTC().Format("20060102T150405Z"))
+	w.line(icsDateTime("DTSTART", e.Start, loc))
+	w.line(icsDateTime("DTEND", e.End, loc))
+	if e.Summary != "" {
+		w.line("SUMMARY:" + icsText(e.Summary))
+	}
+	if e.Description != "" {
+		w.line("DESCRIPTION:" + icsText(e.Description))
+	}
+	if e.Location != "" {
+		w.line("LOCATION:" + icsText(e.Location))
+	}
+	if e.Organizer.Email != "" {
+		w.line("ORGANIZER" + icsCN(e.Organizer.Name) + ":mailto:" + e.Organizer.Email)
+	}
+	for _, a := range e.Attendees {
+		role, partStat := a.Role, a.PartStat
+		if role == "" {
+			role = "REQ-PARTICIPANT"
+		}
+		if partStat == "" {
+			partStat = "NEEDS-ACTION"
+		}
+		line := "ATTENDEE" + icsCN(a.Name) + ";CUTYPE=INDIVIDUAL;ROLE=" + role + ";PARTSTAT=" + partStat
+		if a.RSVP {
+			line += ";RSVP=TRUE"
+		}
+		w.line(line + ":mailto:" + a.Email)
+	}
+	if e.method() == CalendarCancel {
+		w.line("STATUS:CANCELLED")
+	} else {
+		w.line("STATUS:CONFIRMED")
+	}
+	w.line("END:VEVENT")
+	w.line("END:VCALENDAR")
+
+	return w.Bytes(), nil
+}
+
+// AttachCalendar adds the event to m both as a text/calendar alternative,
+// which lets mail clients show accept and decline buttons, and as an
+// invite.ics attachment for clients which ignore the alternative.
+func AttachCalendar(m *gomail.Message, e *CalendarEvent) error {
+	ics, err := e.ICS()
+	if err != nil {
+		return err
+	}
+	contentType := "text/calendar; method=" + e.method()
+
+	m.AddAlternative(contentType, string(ics))
+	m.Attach("invite.ics",
+		gomail.SetHeader(map[string][]string{"Content-Type": {"application/ics; name=\"invite.ics\""}}),
+		gomail.SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(ics)
+			return err
+		}),
+	)
+	return nil
+}
+
+// icsWriter writes content lines folded at 75 octets, see RFC 5545 section 3.1.
+type icsWriter struct {
+	bytes.Buffer
+}
+
+func (w *icsWriter) line(s string) {
+	limit := 75
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		w.WriteString(s[:cut])
+		w.WriteString("\r\n ")
+		s = s[cut:]
+		// The leading space of a continuation counts towards its length.
+		limit = 74
+	}
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+var icsTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func icsText(s string) string {
+	return icsTextEscaper.Replace(s)
+}
+
+// icsCN returns a CN parameter, quoted as names may contain separators.
+func icsCN(name string) string {
+	if name == "" {
+		return ""
+	}
+	return `;CN="` + strings.Replace(name, `"`, "'", -1) + `"`
+}
+
+// icsLocation returns the zone to write times in, or nil for UTC.
+func icsLocation(t time.Time) *time.Location {
+	loc := t.Location()
+	if loc == time.UTC || loc == time.Local || loc.String() == "" || loc.String() == "UTC" {
+		return nil
+	}
+	return loc
+}
+
+func icsDateTime(name string, t time.Time, loc *time.Location) string {
+	if loc == nil {
+		return name + ":" + t.UTC().Format("20060102T150405Z")
+	}
+	return name + ";TZID=" + loc.String() + ":" + t.In(loc).Format("20060102T150405")
+}
+
+// writeVTimezone describes loc for the years spanned by the event with the
+// offset in force at the beginning of the first year and every transition
+// after it.
+func writeVTimezone(w *icsWriter, loc *time.Location, start, end time.Time) {
+	from := time.Date(start.In(loc).Year(), time.January, 1, 0, 0, 0, 0, loc)
+	until := time.Date(end.In(loc).Year()+1, time.January, 1, 0, 0, 0, 0, loc)
+
+	w.line("BEGIN:VTIMEZONE")
+	w.line("TZID:" + loc.String())
+
+	_, offset := from.Zone()
+	writeObservance(w, from, offset)
+
+	for day := from; day.Before(until); day = day.AddDate(0, 0, 1) {
+		next := day.AddDate(0, 0, 1)
+		if _, o := next.Zone(); o == offset {
+			continue
+		}
+		// Bisect to the second of the transition.
+		lo, hi := day.Unix(), next.Unix()
+		for hi-lo > 1 {
+			mid := (lo + hi) / 2
+			if _, o := time.Unix(mid, 0).In(loc).Zone(); o == offset {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		at := time.Unix(hi, 0).In(loc)
+		writeObservance(w, at, offset)
+		_, offset = at.Zone()
+	}
+
+	w.line("END:VTIMEZONE")
+}
+
+// writeObservance writes the STANDARD or DAYLIGHT component starting at at,
+// whose local onset is expressed in the previous offset.
+func writeObservance(w *icsWriter, at time.Time, offsetFrom int) {
+	name, offsetTo := at.Zone()
+	kind := "STANDARD"
+	if at.IsDST() {
+		kind = "DAYLIGHT"
+	}
+	onset := at.UTC().Add(time.Duration(offsetFrom) * time.Second)
+
+	w.line("BEGIN:" + kind)
+	w.line("DTSTART:" + onset.Format("20060102T150405"))
+	w.line("TZOFFSETFROM:" + icsOffset(offsetFrom))
+	w.line("TZOFFSETTO:" + icsOffset(offsetTo))
+	w.line("TZNAME:" + icsText(name))
+	w.line("END:" + kind)
+}
+
+func icsOffset(seconds int) string {
+	sign := "+"
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, seconds/3600, seconds/60%60)
+}
@@ -0,0 +1,126 @@
+package util
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+	"unicode/utf8"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares got with testdata/name, or rewrites it with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	filename := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(filename, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs, got\n%s", name, got)
+	}
+}
+
+func TestCalendarEventICS(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamp := time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		golden string
+		event  CalendarEvent
+	}{
+		{"ical/utc.ics", CalendarEvent{
+			UID:         "event-1@example.com",
+			Summary:     "Planning; budget, Q4",
+			Description: "Agenda:\n1. C:\\reports\n2. Everything else, which makes this description long enough to be folded",
+			Location:    "Room 1",
+			Start:       time.Date(2026, 11, 2, 9, 0, 0, 0, time.UTC),
+			End:         time.Date(2026, 11, 2, 10, 30, 0, 0, time.UTC),
+			Organizer:   CalendarPerson{Name: "Alice", Email: "alice@example.com"},
+			Attendees: []CalendarPerson{
+				{Name: `Bob "B" Smith`, Email: "bob@example.com", RSVP: true},
+				{Email: "carol@example.com", Role: "OPT-PARTICIPANT", PartStat: "ACCEPTED"},
+			},
+			Stamp: stamp,
+		}},
+		{"ical/tzid.ics", CalendarEvent{
+			UID:       "event-2@example.com",
+			Sequence:  2,
+			Method:    CalendarCancel,
+			Summary:   "Über-Meeting",
+			Start:     time.Date(2026, 3, 28, 18, 0, 0, 0, berlin),
+			End:       time.Date(2026, 3, 29, 12, 0, 0, 0, berlin),
+			Organizer: CalendarPerson{Email: "alice@example.com"},
+			Stamp:     stamp,
+			ProdID:    "-//Example//Test//EN",
+		}},
+	} {
+		ics, err := tc.event.ICS()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, tc.golden, ics)
+	}
+}
+
+func TestICSFolding(t *testing.T) {
+	w := &icsWriter{}
+	long := "DESCRIPTION:" + strings.Repeat("abcdefghij", 10) + strings.Repeat("ä", 60)
+	w.line(long)
+	lines := strings.Split(strings.TrimSuffix(w.String(), "\r\n"), "\r\n")
+	if len(lines) < 3 {
+		t.Fatalf("not folded: %q", w.String())
+	}
+	for i, l := range lines {
+		if len(l) > 75 {
+			t.Errorf("line %d has %d octets", i, len(l))
+		}
+		if i > 0 && !strings.HasPrefix(l, " ") {
+			t.Errorf("continuation %d does not start with a space", i)
+		}
+		if !utf8.ValidString(l) {
+			t.Errorf("line %d splits a character", i)
+		}
+	}
+	if unfolded := strings.Replace(strings.TrimSuffix(w.String(), "\r\n"), "\r\n ", "", -1); unfolded != long {
+		t.Errorf("unfolded %q", unfolded)
+	}
+
+	w.Reset()
+	w.line(strings.Repeat("x", 75))
+	if w.String() != strings.Repeat("x", 75)+"\r\n" {
+		t.Errorf("75 octets folded: %q", w.String())
+	}
+}
+
+func TestICSTextEscaping(t *testing.T) {
+	if got := icsText("a,b;c\\d\ne\r\nf"); got != `a\,b\;c\\d\ne\nf` {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestCalendarEventInvalid(t *testing.T) {
+	now := time.Now()
+	for _, e := range []CalendarEvent{
+		{Start: now, End: now},
+		{UID: "x", Start: now, End: now.Add(-time.Hour)},
+	} {
+		if _, err := e.ICS(); err == nil {
+			t.Errorf("%+v: no error", e)
+		}
+	}
+}
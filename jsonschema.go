@@ -0,0 +1,472 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// JsonSchema is a JSON Schema of the draft 2020-12 subset below. Unknown
+// keywords are ignored.
+//
+//	type, enum, const
+//	properties, required, additionalProperties
+//	items, minItems, maxItems, uniqueItems
+//	pattern, minLength, maxLength
+//	minimum, maximum, exclusiveMinimum, exclusiveMaximum
+//	$defs and local $ref ("#" and "#/$defs/name")
+//
+// Patterns use Go regexp syntax, which covers the usual subset of ECMA 262.
+type JsonSchema struct {
+	Type                 jsonSchemaTypes        `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Const                *interface{}           `json:"const"`
+	Properties           map[string]*JsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *JsonSchema            `json:"additionalProperties"`
+	Items                *JsonSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	UniqueItems          bool                   `json:"uniqueItems"`
+	Pattern              string                 `json:"pattern"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Minimum              *json.Number           `json:"minimum"`
+	Maximum              *json.Number           `json:"maximum"`
+	ExclusiveMinimum     *json.Number           `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *json.Number           `json:"exclusiveMaximum"`
+	Defs                 map[string]*JsonSchema `json:"$defs"`
+	Ref                  string                 `json:"$ref"`
+
+	// never is set for the boolean schema false.
+	never   bool
+	pattern *regexp.Regexp
+	root    *JsonSchema
+	// The bounds, parsed by compile.
+	minimum, maximum, exclusiveMinimum, exclusiveMaximum *big.Rat
+}
+
+type jsonSchemaTypes []string
+
+func (t *jsonSchemaTypes) UnmarshalJSON(b []byte) error {
+	var one string
+	if json.Unmarshal(b, &one) == nil {
+		*t = jsonSchemaTypes{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(t))
+}
+
+// UnmarshalJSON accepts the boolean schemas true and false as well.
+func (s *JsonSchema) UnmarshalJSON(b []byte) error {
+	switch string(bytes.TrimSpace(b)) {
+	case "true":
+		*s = JsonSchema{}
+		return nil
+	case "false":
+		*s = JsonSchema{never: true}
+		return nil
+	}
+	type plain JsonSchema
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode((*plain)(s)); err != nil {
+		return err
+	}
+	// Decoding leaves Const nil for "const": null, tell it from no const.
+	var c struct {
+		Const json.RawMessage `json:"const"`
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return err
+	}
+	if string(c.Const) == "null" {
+		s.Const = new(interface{})
+	}
+	return nil
+}
+
+// ParseJsonSchema parses and compiles a schema.
+func ParseJsonSchema(b []byte) (*JsonSchema, error) {
+	s := &JsonSchema{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if err := s.compile(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LoadJsonSchema reads and compiles the schema in filename.
+func LoadJsonSchema(filename string) (*JsonSchema, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, opError("LoadJsonSchema", filename, ErrRead, err)
+	}
+	s, err := ParseJsonSchema(b)
+	if err != nil {
+		return nil, opError("LoadJsonSchema", filename, ErrDecode, err)
+	}
+	return s, nil
+}
+
+func (s *JsonSchema) compile(root *JsonSchema) (err error) {
+	if s == nil {
+		return nil
+	}
+	s.root = root
+	if s.Pattern != "" {
+		if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", s.Pattern, err)
+		}
+	}
+	for _, b := range []struct {
+		name string
+		n    *json.Number
+		r    **big.Rat
+	}{
+		{"minimum", s.Minimum, &s.minimum},
+		{"maximum", s.Maximum, &s.maximum},
+		{"exclusiveMinimum", s.ExclusiveMinimum, &s.exclusiveMinimum},
+		{"exclusiveMaximum", s.ExclusiveMaximum, &s.exclusiveMaximum},
+	} {
+		if b.n == nil {
+			continue
+		}
+		if *b.r = jsonRat(*b.n); *b.r == nil {
+			return fmt.Errorf("invalid %s %s", b.name, *b.n)
+		}
+	}
+	if err = s.checkRefs(); err != nil {
+		return
+	}
+	for _, sub := range s.Properties {
+		if err = sub.compile(root); err != nil {
+			return
+		}
+	}
+	for _, sub := range s.Defs {
+		if err = sub.compile(root); err != nil {
+			return
+		}
+	}
+	if err = s.AdditionalProperties.compile(root); err != nil {
+		return
+	}
+	return s.Items.compile(root)
+}
+
+func (s *JsonSchema) resolve() (*JsonSchema, error) {
+	return s.root.lookup(s.Ref)
+}
+
+// lookup returns the schema ref refers to in root.
+func (root *JsonSchema) lookup(ref string) (*JsonSchema, error) {
+	if ref == "#" {
+		return root, nil
+	}
+	if name := strings.TrimPrefix(ref, "#/$defs/"); name != ref {
+		if d := root.Defs[name]; d != nil {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported $ref %q", ref)
+}
+
+// checkRefs follows the chain of $refs from s, which validate the same value
+// and so would recurse forever if it led back to a schema in it.
+func (s *JsonSchema) checkRefs() error {
+	seen := map[*JsonSchema]bool{s: true}
+	for cur := s; cur.Ref != ""; {
+		next, err := s.root.lookup(cur.Ref)
+		if err != nil {
+			return err
+		}
+		if seen[next] {
+			return fmt.Errorf("$ref %q leads back to itself", s.Ref)
+		}
+		seen[next] = true
+		cur = next
+	}
+	return nil
+}
+
+// JsonSchemaError is a violation of a schema. Path is the JSON Pointer of
+// the offending value, "" for the document itself.
+type JsonSchemaError struct {
+	Path    string
+	Message string
+}
+
+func (e JsonSchemaError) Error() string {
+	if e.Path == "" {
+		return "(root): " + e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// JsonSchemaErrors lists all violations of a document. It matches
+// ErrValidation with errors.Is.
+type JsonSchemaErrors []JsonSchemaError
+
+func (e JsonSchemaErrors) Error() string {
+	s := make([]string, len(e))
+	for i, v := range e {
+		s[i] = v.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+func (e JsonSchemaErrors) Unwrap() error {
+	return ErrValidation
+}
+
+// ValidateJson validates the JSON document raw, returning JsonSchemaErrors
+// for violations.
+func (s *JsonSchema) ValidateJson(raw []byte) error {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	if errs := s.Validate(doc); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Validate validates a document decoded into interface{} values, preferably
+// with json.Decoder.UseNumber so integers are told apart exactly.
+func (s *JsonSchema) Validate(doc interface{}) JsonSchemaErrors {
+	var errs JsonSchemaErrors
+	s.validate(doc, "", &errs)
+	return errs
+}
+
+// WithJsonSchema makes LoadJson validate the document against s before
+// decoding it. All violations are returned as JsonSchemaErrors.
+func WithJsonSchema(s *JsonSchema) FileOption {
+	return func(o *fileOptions) {
+		o.jsonSchema = s
+	}
+}
+
+func (s *JsonSchema) validate(v interface{}, path string, errs *JsonSchemaErrors) {
+	if s == nil {
+		return
+	}
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, JsonSchemaError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if s.never {
+		fail("no value allowed")
+		return
+	}
+	if s.Ref != "" {
+		if ref, err := s.resolve(); err == nil {
+			ref.validate(v, path, errs)
+		}
+	}
+
+	if len(s.Type) > 0 {
+		ok := false
+		for _, t := range s.Type {
+			if jsonTypeMatches(t, v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("expected %s, got %s", strings.Join(s.Type, " or "), jsonTypeOf(v))
+			return
+		}
+	}
+	if s.Enum != nil {
+		ok := false
+		for _, e := range s.Enum {
+			if jsonEqual(e, v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("must be one of %s", jsonList(s.Enum))
+		}
+	}
+	if s.Const != nil && !jsonEqual(*s.Const, v) {
+		fail("must be %s", jsonList([]interface{}{*s.Const}))
+	}
+
+	switch v := v.(type) {
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("must be at most %d characters long", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match %q", s.Pattern)
+		}
+	case json.Number, float64:
+		if s.minimum == nil && s.maximum == nil && s.exclusiveMinimum == nil && s.exclusiveMaximum == nil {
+			break
+		}
+		n := jsonRat(v)
+		if n == nil {
+			// E.g. an exponent too large for big.Rat.
+			fail("cannot compare %v", v)
+			break
+		}
+		if s.minimum != nil && n.Cmp(s.minimum) < 0 {
+			fail("must be >= %s", *s.Minimum)
+		}
+		if s.maximum != nil && n.Cmp(s.maximum) > 0 {
+			fail("must be <= %s", *s.Maximum)
+		}
+		if s.exclusiveMinimum != nil && n.Cmp(s.exclusiveMinimum) <= 0 {
+			fail("must be > %s", *s.ExclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && n.Cmp(s.exclusiveMaximum) >= 0 {
+			fail("must be < %s", *s.ExclusiveMaximum)
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if sub, ok := s.Properties[k]; ok {
+				sub.validate(v[k], jsonPointer(path, k), errs)
+			} else if s.AdditionalProperties != nil {
+				if s.AdditionalProperties.never {
+					*errs = append(*errs, JsonSchemaError{Path: jsonPointer(path, k), Message: "unknown property"})
+				} else {
+					s.AdditionalProperties.validate(v[k], jsonPointer(path, k), errs)
+				}
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.UniqueItems {
+		unique:
+			for i := range v {
+				for j := 0; j < i; j++ {
+					if jsonEqual(v[i], v[j]) {
+						fail("items %d and %d are equal", j, i)
+						break unique
+					}
+				}
+			}
+		}
+		for i, item := range v {
+			s.Items.validate(item, jsonPointer(path, fmt.Sprint(i)), errs)
+		}
+	}
+}
+
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func jsonPointer(path, token string) string {
+	return path + "/" + jsonPointerEscaper.Replace(token)
+}
+
+func jsonTypeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number, float64:
+		return "number"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func jsonTypeMatches(t string, v interface{}) bool {
+	if t == "integer" {
+		n := jsonRat(v)
+		return n != nil && n.IsInt()
+	}
+	return t == jsonTypeOf(v)
+}
+
+// jsonRat returns the exact value of a number, nil for other values.
+func jsonRat(v interface{}) *big.Rat {
+	switch v := v.(type) {
+	case json.Number:
+		if r, ok := new(big.Rat).SetString(string(v)); ok {
+			return r
+		}
+	case float64:
+		return new(big.Rat).SetFloat64(v)
+	}
+	return nil
+}
+
+// jsonEqual compares JSON values, numbers by value.
+func jsonEqual(a, b interface{}) bool {
+	if ra, rb := jsonRat(a), jsonRat(b); ra != nil || rb != nil {
+		return ra != nil && rb != nil && ra.Cmp(rb) == 0
+	}
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func jsonList(values []interface{}) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		b, _ := json.Marshal(v)
+		s[i] = string(b)
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,87 @@
+package util
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestJsonSchemaValidate(t *testing.T) {
+	s, err := ParseJsonSchema([]byte(`{
+		"type": "object",
+		"required": ["name"],
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"port": {"type": "integer", "minimum": 1, "maximum": 65535},
+			"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "uniqueItems": true},
+			"child": {"$ref": "#"}
+		},
+		"additionalProperties": false,
+		"$defs": {"tag": {"type": "string", "pattern": "^[a-z]+$"}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for doc, want := range map[string]string{
+		`{"name": "a", "port": 80, "tags": ["x", "y"], "child": {"name": "b"}}`: "",
+		`{"port": 80.5}`:                           "(root): missing required property \"name\"; /port: expected integer, got number",
+		`{"name": "a", "tags": ["x", "x"]}`:        "/tags: items 0 and 1 are equal",
+		`{"name": "a", "child": {"name": ""}}`:     "/child/name: must be at least 1 characters long",
+		`{"name": "a", "tags": ["X"], "other": 1}`: "/other: unknown property; /tags/0: must match \"^[a-z]+$\"",
+	} {
+		err := s.ValidateJson([]byte(doc))
+		if want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", doc, err)
+			}
+		} else if err == nil || err.Error() != want || !errors.Is(err, ErrValidation) {
+			t.Errorf("%s: got %v, want %s", doc, err, want)
+		}
+	}
+}
+
+func TestJsonSchemaRejectsRefCycles(t *testing.T) {
+	for _, schema := range []string{
+		`{"$ref": "#"}`,
+		`{"$defs": {"a": {"$ref": "#/$defs/a"}}, "properties": {"x": {"$ref": "#/$defs/a"}}}`,
+		`{"$defs": {"a": {"$ref": "#/$defs/b"}, "b": {"$ref": "#/$defs/a"}}}`,
+		`{"$ref": "#/$defs/a", "$defs": {"a": {"$ref": "#"}}}`,
+	} {
+		if _, err := ParseJsonSchema([]byte(schema)); err == nil {
+			t.Errorf("%s: compiled", schema)
+		}
+	}
+}
+
+func TestJsonSchemaConstNull(t *testing.T) {
+	s, err := ParseJsonSchema([]byte(`{"properties": {"a": {"const": null}, "b": {"const": 0}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.ValidateJson([]byte(`{"a": null, "b": 0}`)); err != nil {
+		t.Error(err)
+	}
+	err = s.ValidateJson([]byte(`{"a": 0, "b": null}`))
+	if want := "/a: must be null; /b: must be 0"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+}
+
+func TestJsonSchemaHugeNumbers(t *testing.T) {
+	s, err := ParseJsonSchema([]byte(`{"properties": {"x": {"maximum": 10}, "y": {}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.ValidateJson([]byte(`{"x": 1e9999999, "y": 1e9999999}`))
+	if want := "/x: cannot compare 1e9999999"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+
+	for _, schema := range []string{
+		`{"minimum": 1e9999999}`,
+		`{"properties": {"x": {"exclusiveMaximum": -1e9999999}}}`,
+	} {
+		if _, err := ParseJsonSchema([]byte(schema)); err == nil {
+			t.Errorf("%s: compiled", schema)
+		}
+	}
+}
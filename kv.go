@@ -0,0 +1,503 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// KVOptions configures OpenKV. The zero value is usable.
+type KVOptions struct {
+	// Codec encodes the values, JSON if nil.
+	Codec Codec
+	// FileMode of a new store, DefaultFileMode if zero.
+	FileMode os.FileMode
+	// NoSync skips the fsync after every write, trading durability of the
+	// last writes on power loss for speed.
+	NoSync bool
+	// The log is compacted after a write once it holds more than
+	// CompactMinSize bytes (1 MiB if zero) of which more than CompactRatio
+	// (0.5 if zero) are overwritten or deleted records. A negative
+	// CompactMinSize disables automatic compaction.
+	CompactMinSize int64
+	CompactRatio   float64
+}
+
+// KV is an embedded key-value store kept in a single append-only log file.
+// Keys and the position of their values are held in memory; values are read
+// from the file. A KV is safe for concurrent use, and only one process at a
+// time can open a store.
+//
+// Every record is checksummed. When opening a store a torn last record, as
+// left by a crash during a write, is truncated; a corrupt record followed by
+// others fails OpenKV with ErrDecode.
+type KV struct {
+	mu       sync.RWMutex
+	filename string
+	o        KVOptions
+	f        *os.File
+	lock     *os.File
+	index    map[string]kvEntry
+	size     int64
+	live     int64
+}
+
+type kvEntry struct {
+	offset int64 // of the value
+	length int64
+	record int64 // size of the whole record
+}
+
+// The log starts with kvMagic followed by records of
+//
+//	crc32   4 bytes, Castagnoli, of the rest of the record
+//	op      1 byte
+//	key     4 bytes big endian length, key
+//	value   4 bytes big endian length, value
+var kvMagic = []byte("GKV\x01")
+
+const (
+	kvPut    = 1
+	kvDelete = 2
+
+	kvHeaderSize = 4 + 1 + 4 + 4
+)
+
+var kvTable = crc32.MakeTable(crc32.Castagnoli)
+
+// OpenKV opens the store in filename, creating it if needed. o may be nil.
+// The store is locked through the file filename+".lock" until Close.
+func OpenKV(filename string, o *KVOptions) (*KV, error) {
+	db := &KV{filename: filename}
+	if o != nil {
+		db.o = *o
+	}
+	if db.o.Codec == nil {
+		db.o.Codec = jsonCodec{}
+	}
+	if db.o.FileMode == 0 {
+		db.o.FileMode = DefaultFileMode
+	}
+	if db.o.CompactMinSize == 0 {
+		db.o.CompactMinSize = 1 << 20
+	}
+	if db.o.CompactRatio == 0 {
+		db.o.CompactRatio = 0.5
+	}
+
+	lock, err := os.OpenFile(filename+".lock", os.O_RDWR|os.O_CREATE, db.o.FileMode)
+	if err != nil {
+		return nil, opError("OpenKV", filename, ErrRead, err)
+	}
+	if err = lockFile(lock); err != nil {
+		lock.Close()
+		return nil, opError("OpenKV", filename, ErrLocked, err)
+	}
+	db.lock = lock
+
+	if err = db.open(); err != nil {
+		db.closeFiles()
+		return nil, opError("OpenKV", filename, ErrRead, err)
+	}
+	return db, nil
+}
+
+// open opens the log and rebuilds the index, truncating a torn last record.
+func (db *KV) open() (err error) {
+	db.f, err = os.OpenFile(db.filename, os.O_RDWR|os.O_CREATE, db.o.FileMode)
+	if err != nil {
+		return
+	}
+	fi, err := db.f.Stat()
+	if err != nil {
+		return
+	}
+	if fi.Size() < int64(len(kvMagic)) {
+		// New, or torn while writing the magic.
+		if err = db.f.Truncate(0); err != nil {
+			return
+		}
+		if _, err = db.f.WriteAt(kvMagic, 0); err != nil {
+			return
+		}
+		db.index, db.size, db.live = make(map[string]kvEntry), int64(len(kvMagic)), 0
+		return db.f.Sync()
+	}
+
+	magic := make([]byte, len(kvMagic))
+	if _, err = db.f.ReadAt(magic, 0); err != nil {
+		return
+	}
+	if !bytes.Equal(magic, kvMagic) {
+		return fmt.Errorf("%w: not a key-value store", ErrDecode)
+	}
+
+	db.index, db.live = make(map[string]kvEntry), 0
+	r := bufio.NewReader(io.NewSectionReader(db.f, 0, fi.Size()))
+	r.Discard(len(kvMagic))
+	offset := int64(len(kvMagic))
+	for {
+		op, key, value, n, err := readKVRecord(r, fi.Size()-offset)
+		if err == io.EOF || err == errKVTorn {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: record at offset %d: %v", ErrDecode, offset, err)
+		}
+		db.apply(op, key, offset+kvHeaderSize+int64(len(key)), int64(len(value)), n)
+		offset += n
+	}
+	db.size = offset
+
+	if offset < fi.Size() {
+		logError(fmt.Errorf("OpenKV %s: truncating a torn record of %d bytes", db.filename, fi.Size()-offset))
+		if err = db.f.Truncate(offset); err != nil {
+			return
+		}
+		return db.f.Sync()
+	}
+	return nil
+}
+
+// errKVTorn is returned by readKVRecord for a record cut short at the end of
+// the log.
+var errKVTorn = errors.New("torn record")
+
+// readKVRecord reads one record of at most remaining bytes and returns its
+// size. It returns io.EOF at the end of the log and errKVTorn when the last
+// record is incomplete or, ending the log, fails its checksum.
+func readKVRecord(r *bufio.Reader, remaining int64) (op byte, key string, value []byte, n int64, err error) {
+	var h [kvHeaderSize]byte
+	if _, err = io.ReadFull(r, h[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errKVTorn
+		}
+		return
+	}
+	op = h[4]
+	keyLen := binary.BigEndian.Uint32(h[5:9])
+	valueLen := binary.BigEndian.Uint32(h[9:13])
+	// Check the lengths before allocating, a torn header may hold anything.
+	n = kvHeaderSize + int64(keyLen) + int64(valueLen)
+	if n > remaining {
+		err = errKVTorn
+		return
+	}
+	last := n == remaining
+	if op != kvPut && op != kvDelete {
+		err = errors.New("bad record")
+		if last {
+			err = errKVTorn
+		}
+		return
+	}
+	body := make([]byte, int(keyLen)+int(valueLen))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	crc := crc32.Update(crc32.Checksum(h[4:], kvTable), kvTable, body)
+	if crc != binary.BigEndian.Uint32(h[:4]) {
+		err = errors.New("bad checksum")
+		if last {
+			err = errKVTorn
+		}
+		return
+	}
+	return op, string(body[:keyLen]), body[keyLen:], n, nil
+}
+
+func appendKVRecord(b []byte, op byte, key string, value []byte) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0, op)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(key)))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(value)))
+	b = append(b, key...)
+	b = append(b, value...)
+	binary.BigEndian.PutUint32(b[start:], crc32.Checksum(b[start+4:], kvTable))
+	return b
+}
+
+// apply updates the index with a record.
+func (db *KV) apply(op byte, key string, valueOffset, valueLength, record int64) {
+	if old, ok := db.index[key]; ok {
+		db.live -= old.record
+	}
+	if op == kvDelete {
+		delete(db.index, key)
+		return
+	}
+	db.index[key] = kvEntry{offset: valueOffset, length: valueLength, record: record}
+	db.live += record
+}
+
+// Get decodes the value of key into value, returning ErrNotFound for missing
+// keys.
+func (db *KV) Get(key string, value interface{}) error {
+	db.mu.RLock()
+	if db.f == nil {
+		db.mu.RUnlock()
+		return opError("KV.Get", db.filename, ErrClosed, nil)
+	}
+	e, ok := db.index[key]
+	if !ok {
+		db.mu.RUnlock()
+		// A missing key is not a failure worth logging.
+		return &OpError{Op: "KV.Get", Path: db.filename, Kind: ErrNotFound}
+	}
+	b := make([]byte, e.length)
+	_, err := db.f.ReadAt(b, e.offset)
+	db.mu.RUnlock()
+	if err != nil {
+		return opError("KV.Get", db.filename, ErrRead, err)
+	}
+	if err = db.o.Codec.Decode(bytes.NewReader(b), value); err != nil {
+		return opError("KV.Get", db.filename, ErrDecode, err)
+	}
+	return nil
+}
+
+// Has reports whether key is present.
+func (db *KV) Has(key string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	_, ok := db.index[key]
+	return ok
+}
+
+// Len returns the number of keys.
+func (db *KV) Len() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.index)
+}
+
+// Keys returns the keys in sorted order.
+func (db *KV) Keys() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	keys := make([]string, 0, len(db.index))
+	for k := range db.index {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Put stores value under key.
+func (db *KV) Put(key string, value interface{}) error {
+	var buf bytes.Buffer
+	if err := db.o.Codec.Encode(&buf, value); err != nil {
+		return opError("KV.Put", db.filename, ErrEncode, err)
+	}
+	return db.write("KV.Put", kvPut, key, buf.Bytes())
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (db *KV) Delete(key string) error {
+	return db.write("KV.Delete", kvDelete, key, nil)
+}
+
+func (db *KV) write(op string, kind byte, key string, value []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.f == nil {
+		return opError(op, db.filename, ErrClosed, nil)
+	}
+	if _, ok := db.index[key]; !ok && kind == kvDelete {
+		return nil
+	}
+
+	record := appendKVRecord(nil, kind, key, value)
+	if _, err := db.f.WriteAt(record, db.size); err != nil {
+		// Drop the partial record so the next write does not follow it.
+		db.f.Truncate(db.size)
+		return opError(op, db.filename, ErrWrite, err)
+	}
+	if !db.o.NoSync {
+		if err := db.f.Sync(); err != nil {
+			return opError(op, db.filename, ErrWrite, err)
+		}
+	}
+	db.apply(kind, key, db.size+kvHeaderSize+int64(len(key)), int64(len(value)), int64(len(record)))
+	db.size += int64(len(record))
+
+	if db.o.CompactMinSize >= 0 && db.size > db.o.CompactMinSize &&
+		float64(db.size-db.live) > db.o.CompactRatio*float64(db.size) {
+		// The write is durable already, a failed compaction is retried
+		// after the next one.
+		if err := db.compact(); err != nil {
+			logError(opError(op, db.filename, ErrWrite, err))
+		}
+	}
+	return nil
+}
+
+// Iterate calls fn for every key in sorted order with a function decoding
+// its value. Iteration stops at the first error, which is returned. fn must
+// not write to the store.
+func (db *KV) Iterate(fn func(key string, decode func(value interface{}) error) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.f == nil {
+		return opError("KV.Iterate", db.filename, ErrClosed, nil)
+	}
+	keys := make([]string, 0, len(db.index))
+	for k := range db.index {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		e := db.index[k]
+		decode := func(value interface{}) error {
+			r := io.NewSectionReader(db.f, e.offset, e.length)
+			if err := db.o.Codec.Decode(r, value); err != nil {
+				return opError("KV.Iterate", db.filename, ErrDecode, err)
+			}
+			return nil
+		}
+		if err := fn(k, decode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact rewrites the log with only the current values.
+func (db *KV) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.f == nil {
+		return opError("KV.Compact", db.filename, ErrClosed, nil)
+	}
+	if err := db.compact(); err != nil {
+		return opError("KV.Compact", db.filename, ErrWrite, err)
+	}
+	return nil
+}
+
+func (db *KV) compact() (err error) {
+	dir := filepath.Dir(db.filename)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(db.filename)+".compact*")
+	if err != nil {
+		return
+	}
+	renamed := false
+	defer func() {
+		if err != nil && !renamed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err = tmp.Chmod(db.o.FileMode); err != nil {
+		return
+	}
+
+	w := bufio.NewWriter(tmp)
+	w.Write(kvMagic)
+	index := make(map[string]kvEntry, len(db.index))
+	offset := int64(len(kvMagic))
+	var record []byte
+	for k, e := range db.index {
+		value := make([]byte, e.length)
+		if _, err = db.f.ReadAt(value, e.offset); err != nil {
+			return
+		}
+		record = appendKVRecord(record[:0], kvPut, k, value)
+		if _, err = w.Write(record); err != nil {
+			return
+		}
+		index[k] = kvEntry{offset: offset + kvHeaderSize + int64(len(k)), length: e.length, record: int64(len(record))}
+		offset += int64(len(record))
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		return
+	}
+
+	// Windows cannot rename over an open file, so there both are closed
+	// and the new log is opened again.
+	if runtime.GOOS == "windows" {
+		tmp.Close()
+		db.f.Close()
+		err = os.Rename(tmp.Name(), db.filename)
+		f, er := os.OpenFile(db.filename, os.O_RDWR, 0)
+		if er != nil {
+			// Neither log can be used, leave the store closed.
+			db.f = nil
+			db.closeFiles()
+			if err == nil {
+				renamed, err = true, er
+			}
+			return
+		}
+		db.f = f
+		if err != nil {
+			return
+		}
+		renamed = true
+	} else {
+		if err = os.Rename(tmp.Name(), db.filename); err != nil {
+			return
+		}
+		renamed = true
+		db.f.Close()
+		db.f = tmp
+	}
+	db.index, db.size, db.live = index, offset, offset-int64(len(kvMagic))
+	return syncDir(dir)
+}
+
+// Sync flushes writes made with NoSync to disk.
+func (db *KV) Sync() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.f == nil {
+		return opError("KV.Sync", db.filename, ErrClosed, nil)
+	}
+	if err := db.f.Sync(); err != nil {
+		return opError("KV.Sync", db.filename, ErrWrite, err)
+	}
+	return nil
+}
+
+// Close syncs and closes the store and releases its lock.
+func (db *KV) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.f == nil {
+		return opError("KV.Close", db.filename, ErrClosed, nil)
+	}
+	err := db.f.Sync()
+	if er := db.closeFiles(); err == nil {
+		err = er
+	}
+	if err != nil {
+		return opError("KV.Close", db.filename, ErrWrite, err)
+	}
+	return nil
+}
+
+func (db *KV) closeFiles() (err error) {
+	if db.f != nil {
+		err = db.f.Close()
+		db.f = nil
+	}
+	if db.lock != nil {
+		unlockFile(db.lock)
+		db.lock.Close()
+		db.lock = nil
+	}
+	return
+}
@@ -0,0 +1,132 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKVPutGetReopen(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "db")
+	db, err := OpenKV(filename, &KVOptions{CompactMinSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if err = db.Put(fmt.Sprint("k", i%10), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Delete("k0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenKV(filename, nil); !errors.Is(err, ErrLocked) {
+		t.Errorf("second open: %v", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(filename); fi.Size() > 1024 {
+		t.Errorf("not compacted, %d bytes", fi.Size())
+	}
+
+	db, err = OpenKV(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Len() != 9 || db.Has("k0") {
+		t.Errorf("keys %v", db.Keys())
+	}
+	var v int
+	if err = db.Get("k9", &v); err != nil || v != 199 {
+		t.Errorf("k9 = %d, %v", v, err)
+	}
+}
+
+func TestKVTruncatesTornTail(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "db")
+	db, err := OpenKV(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("a", 1)
+	db.Close()
+	fi, _ := os.Stat(filename)
+
+	for _, tail := range [][]byte{
+		// A header claiming lengths far beyond the file.
+		{0, 0, 0, 0, kvPut, 0xff, 0xff, 0xff, 0xf0, 0xff, 0xff, 0xff, 0xf0},
+		// A record cut short.
+		appendKVRecord(nil, kvPut, "b", []byte("2"))[:14],
+		// A last record failing its checksum.
+		corruptKVRecord(appendKVRecord(nil, kvPut, "b", []byte("2"))),
+	} {
+		f, _ := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+		f.Write(tail)
+		f.Close()
+
+		db, err = OpenKV(filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v int
+		if err = db.Get("a", &v); err != nil || v != 1 || db.Len() != 1 {
+			t.Errorf("a = %d, %v, %d keys", v, err, db.Len())
+		}
+		db.Close()
+		if after, _ := os.Stat(filename); after.Size() != fi.Size() {
+			t.Errorf("size %d, want %d", after.Size(), fi.Size())
+		}
+	}
+}
+
+// corruptKVRecord flips a bit of the last byte of the record in b.
+func corruptKVRecord(b []byte) []byte {
+	b[len(b)-1] ^= 1
+	return b
+}
+
+func TestKVFailsOnCorruptRecord(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "db")
+	db, err := OpenKV(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("a", 1)
+	db.Put("b", 2)
+	db.Close()
+	b, _ := os.ReadFile(filename)
+	// The value of a, in the first record.
+	b[len(kvMagic)+kvHeaderSize+1] ^= 1
+	os.WriteFile(filename, b, 0644)
+
+	if _, err = OpenKV(filename, nil); !errors.Is(err, ErrDecode) {
+		t.Errorf("got %v, want ErrDecode", err)
+	}
+	if after, _ := os.ReadFile(filename); !bytes.Equal(after, b) {
+		t.Error("store modified")
+	}
+}
+
+func TestKVErrors(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "db")
+	db, err := OpenKV(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var opErr *OpError
+	if err = db.Get("a", &v); !errors.Is(err, ErrNotFound) || !errors.As(err, &opErr) || opErr.Path != filename {
+		t.Errorf("Get: %v", err)
+	}
+	db.Close()
+	for _, err := range []error{db.Get("a", &v), db.Put("a", 1), db.Delete("a"), db.Sync(), db.Close()} {
+		if !errors.Is(err, ErrClosed) || !errors.As(err, &opErr) {
+			t.Errorf("got %v, want ErrClosed", err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDNSTimeout     = 5 * time.Second
+	DefaultDomainCacheTTL = time.Hour
+)
+
+// ReasonNoMailHost is reported by DomainChecker.CheckAddress for domains
+// without MX, A or AAAA records, or with a null MX.
+const ReasonNoMailHost AddressReason = "domain does not accept mail"
+
+// Resolver is the part of *net.Resolver used by DomainChecker. Tests can
+// supply a fake to run without network access.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// DomainStatus is the result of a deliverability lookup.
+type DomainStatus struct {
+	Domain string
+	// MX hosts ordered by preference.
+	MX []string
+	// Implicit is set when there are no MX records and the domain's own
+	// A/AAAA records are used (RFC 5321 section 5.1).
+	Implicit bool
+	// NullMX is set when the domain declares it accepts no mail (RFC 7505).
+	NullMX bool
+}
+
+// Deliverable reports whether the domain has a host to deliver mail to.
+func (s *DomainStatus) Deliverable() bool {
+	return !s.NullMX && len(s.MX) > 0
+}
+
+type domainCacheEntry struct {
+	status  *DomainStatus
+	expires time.Time
+}
+
+// DomainChecker looks up whether domains can receive mail and caches the
+// answers. The zero value is ready to use and safe for concurrent use.
+type DomainChecker struct {
+	// Resolver defaults to net.DefaultResolver.
+	Resolver Resolver
+	// Timeout bounds each lookup, DefaultDNSTimeout if zero.
+	Timeout time.Duration
+	// TTL of cached answers, DefaultDomainCacheTTL if zero. Negative disables
+	// caching.
+	TTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]domainCacheEntry
+}
+
+// NewDomainChecker returns a DomainChecker using r.
+func NewDomainChecker(r Resolver) *DomainChecker {
+	return &DomainChecker{Resolver: r}
+}
+
+// CheckDomain resolves the mail hosts of an ASCII domain. Domains that do not
+// exist yield an undeliverable status; an error is returned only when the
+// lookup itself fails, e.g. on timeouts, and such results are not cached.
+func (c *DomainChecker) CheckDomain(ctx context.Context, domain string) (*DomainStatus, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	if s := c.cached(domain); s != nil {
+		return s, nil
+	}
+
+	s, err := c.lookup(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = DefaultDomainCacheTTL
+	}
+	if ttl > 0 {
+		c.mu.Lock()
+		if c.cache == nil {
+			c.cache = make(map[string]domainCacheEntry)
+		}
+		c.cache[domain] = domainCacheEntry{status: s, expires: time.Now().Add(ttl)}
+		c.mu.Unlock()
+	}
+	return s, nil
+}
+
+// CheckAddress parses s with ParseAddress and then checks its domain.
+// Undeliverable domains are reported as *AddressError with ReasonNoMailHost.
+func (c *DomainChecker) CheckAddress(ctx context.Context, s string, o *AddressOptions) (*Address, error) {
+	a, err := ParseAddress(s, o)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(a.Domain, "[") {
+		return a, nil
+	}
+	status, err := c.CheckDomain(ctx, a.Domain)
+	if err != nil {
+		return nil, err
+	}
+	if !status.Deliverable() {
+		return nil, &AddressError{Address: s, Reason: ReasonNoMailHost}
+	}
+	return a, nil
+}
+
+func (c *DomainChecker) cached(domain string) *DomainStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.cache[domain]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.cache, domain)
+		return nil
+	}
+	return e.status
+}
+
+func (c *DomainChecker) lookup(ctx context.Context, domain string) (*DomainStatus, error) {
+	r := c.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultDNSTimeout
+	}
+
+	s := &DomainStatus{Domain: domain}
+
+	mctx, cancel := context.WithTimeout(ctx, timeout)
+	mxs, err := r.LookupMX(mctx, domain)
+	cancel()
+	if err != nil && !isDNSNotFound(err) {
+		return nil, err
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" && len(mxs) == 1 {
+			s.NullMX = true
+			return s, nil
+		}
+		if host != "" {
+			s.MX = append(s.MX, host)
+		}
+	}
+	if len(s.MX) > 0 {
+		return s, nil
+	}
+
+	hctx, cancel := context.WithTimeout(ctx, timeout)
+	addrs, err := r.LookupHost(hctx, domain)
+	cancel()
+	if err != nil && !isDNSNotFound(err) {
+		return nil, err
+	}
+	if len(addrs) > 0 {
+		s.MX = []string{domain}
+		s.Implicit = true
+	}
+	return s, nil
+}
+
+func isDNSNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
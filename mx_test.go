@@ -0,0 +1,144 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers from maps; domains in neither fail with NXDOMAIN.
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	// fail makes lookups of the domain fail with a temporary error.
+	fail map[string]bool
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (r *fakeResolver) lookup(name string) error {
+	r.mu.Lock()
+	r.calls++
+	r.mu.Unlock()
+	if r.fail[name] {
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	err := r.lookup(name)
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, err
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	err := r.lookup(host)
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, err
+}
+
+func newFakeResolver() *fakeResolver {
+	return &fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com":  {{Host: "mx2.example.com.", Pref: 20}, {Host: "mx1.example.com.", Pref: 10}, {Host: "mx3.example.com.", Pref: 30}},
+			"null.example": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{
+			"implicit.example": {"192.0.2.1"},
+			"null.example":     {"192.0.2.2"},
+		},
+		fail: map[string]bool{"broken.example": true},
+	}
+}
+
+func TestCheckDomain(t *testing.T) {
+	c := NewDomainChecker(newFakeResolver())
+	ctx := context.Background()
+	for _, tc := range []struct {
+		domain      string
+		mx          string
+		implicit    bool
+		nullMX      bool
+		deliverable bool
+	}{
+		{"Example.COM.", "mx1.example.com mx2.example.com mx3.example.com", false, false, true},
+		{"implicit.example", "implicit.example", true, false, true},
+		{"null.example", "", false, true, false},
+		{"missing.example", "", false, false, false},
+	} {
+		s, err := c.CheckDomain(ctx, tc.domain)
+		if err != nil {
+			t.Errorf("%s: %v", tc.domain, err)
+			continue
+		}
+		if got := strings.Join(s.MX, " "); got != tc.mx || s.Implicit != tc.implicit ||
+			s.NullMX != tc.nullMX || s.Deliverable() != tc.deliverable {
+			t.Errorf("%s: got %+v, deliverable %v", tc.domain, s, s.Deliverable())
+		}
+	}
+
+	var dnsErr *net.DNSError
+	if _, err := c.CheckDomain(ctx, "broken.example"); !errors.As(err, &dnsErr) || !dnsErr.IsTemporary {
+		t.Errorf("broken.example: got %v, want a temporary DNS error", err)
+	}
+}
+
+func TestCheckAddressNoMailHost(t *testing.T) {
+	c := NewDomainChecker(newFakeResolver())
+	for addr, want := range map[string]AddressReason{
+		"john@example.com":      "",
+		"john@null.example":     ReasonNoMailHost,
+		"john@missing.example":  ReasonNoMailHost,
+		"john@implicit.example": "",
+	} {
+		_, err := c.CheckAddress(context.Background(), addr, nil)
+		var ae *AddressError
+		if want == "" && err != nil || want != "" && (!errors.As(err, &ae) || ae.Reason != want) {
+			t.Errorf("%s: got %v, want %q", addr, err, want)
+		}
+	}
+}
+
+func TestCheckDomainCache(t *testing.T) {
+	r := newFakeResolver()
+	c := &DomainChecker{Resolver: r, TTL: 50 * time.Millisecond}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.CheckDomain(ctx, "example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.calls != 1 {
+		t.Errorf("%d lookups, want 1", r.calls)
+	}
+	// Temporary failures are not cached.
+	c.CheckDomain(ctx, "broken.example")
+	c.CheckDomain(ctx, "broken.example")
+	if r.calls != 3 {
+		t.Errorf("%d lookups, want 3", r.calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	c.CheckDomain(ctx, "example.com")
+	if r.calls != 4 {
+		t.Errorf("%d lookups after expiry, want 4", r.calls)
+	}
+
+	c = &DomainChecker{Resolver: r, TTL: -1}
+	c.CheckDomain(ctx, "example.com")
+	c.CheckDomain(ctx, "example.com")
+	if r.calls != 6 {
+		t.Errorf("%d lookups without cache, want 6", r.calls)
+	}
+}
@@ -0,0 +1,200 @@
+package util
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// PGPOptions configures OpenPGP protection of outgoing messages (PGP/MIME,
+// RFC 3156).
+type PGPOptions struct {
+	// Encrypt the message to every recipient. Their public keys are looked
+	// up in Keys by the email of the key identities; a recipient without a key
+	// fails the send rather than leaking the plaintext.
+	Encrypt bool
+	Keys    openpgp.EntityList
+	// Signer signs the message when set. Its private key must be decrypted.
+	Signer *openpgp.Entity
+	// Config is passed to the OpenPGP library, nil for defaults.
+	Config *packet.Config
+}
+
+func (o *PGPOptions) validate() error {
+	if !o.Encrypt && o.Signer == nil {
+		return errors.New("pgp: neither encryption nor signing requested")
+	}
+	if o.Signer != nil && (o.Signer.PrivateKey == nil || o.Signer.PrivateKey.Encrypted) {
+		return errors.New("pgp: signer has no usable private key")
+	}
+	return nil
+}
+
+// config forces SHA-256 so the micalg parameter is known in advance.
+func (o *PGPOptions) config() *packet.Config {
+	c := packet.Config{}
+	if o.Config != nil {
+		c = *o.Config
+	}
+	c.DefaultHash = crypto.SHA256
+	return &c
+}
+
+// NewPGPTransport returns a wrapper which encrypts and/or signs every message
+// before handing it to the wrapped Transport. An error is returned only for
+// invalid options. When combined with DKIM, register the PGP wrapper first.
+func NewPGPTransport(o PGPOptions) (func(Transport) Transport, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	return func(t Transport) Transport {
+		return &pgpTransport{Transport: t, options: o}
+	}, nil
+}
+
+type pgpTransport struct {
+	Transport
+	options PGPOptions
+}
+
+func (t *pgpTransport) Send(from string, to []string, msg io.WriterTo) error {
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return err
+	}
+	protected, err := PGPProtect(buf.Bytes(), to, &t.options)
+	if err != nil {
+		return err
+	}
+	return t.Transport.Send(from, to, bytes.NewReader(protected))
+}
+
+// PGPProtect turns raw into a multipart/signed or multipart/encrypted message.
+// The content headers move into the protected part, all other headers,
+// including Subject, stay visible.
+func PGPProtect(raw []byte, to []string, o *PGPOptions) ([]byte, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	config := o.config()
+
+	fields, body := splitMessage(raw)
+	var outer, inner bytes.Buffer
+	for _, f := range fields {
+		if strings.HasPrefix(strings.ToLower(headerFieldName(f)), "content-") {
+			inner.WriteString(f)
+		} else if !strings.EqualFold(headerFieldName(f), "Mime-Version") {
+			outer.WriteString(f)
+		}
+	}
+	if inner.Len() == 0 {
+		inner.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	}
+	inner.WriteString("\r\n")
+	inner.Write(body)
+
+	boundary, err := mimeBoundary()
+	if err != nil {
+		return nil, err
+	}
+	outer.WriteString("Mime-Version: 1.0\r\n")
+
+	if !o.Encrypt {
+		var sig bytes.Buffer
+		if err := openpgp.ArmoredDetachSign(&sig, o.Signer, bytes.NewReader(inner.Bytes()), config); err != nil {
+			return nil, fmt.Errorf("pgp: %v", err)
+		}
+		fmt.Fprintf(&outer, "Content-Type: multipart/signed; micalg=pgp-sha256;\r\n protocol=\"application/pgp-signature\";\r\n boundary=\"%s\"\r\n\r\n", boundary)
+		fmt.Fprintf(&outer, "--%s\r\n", boundary)
+		outer.Write(inner.Bytes())
+		fmt.Fprintf(&outer, "\r\n--%s\r\n", boundary)
+		outer.WriteString("Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n")
+		outer.WriteString("Content-Description: OpenPGP digital signature\r\n\r\n")
+		outer.Write(crlf(sig.Bytes()))
+		fmt.Fprintf(&outer, "\r\n--%s--\r\n", boundary)
+		return outer.Bytes(), nil
+	}
+
+	keys, err := pgpRecipientKeys(o.Keys, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var encrypted bytes.Buffer
+	aw, err := armor.Encode(&encrypted, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := openpgp.Encrypt(aw, keys, o.Signer, nil, config)
+	if err != nil {
+		return nil, fmt.Errorf("pgp: %v", err)
+	}
+	if _, err = pw.Write(inner.Bytes()); err != nil {
+		return nil, err
+	}
+	if err = pw.Close(); err != nil {
+		return nil, err
+	}
+	if err = aw.Close(); err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(&outer, "Content-Type: multipart/encrypted;\r\n protocol=\"application/pgp-encrypted\";\r\n boundary=\"%s\"\r\n\r\n", boundary)
+	outer.WriteString("This is an OpenPGP/MIME encrypted message (RFC 3156).\r\n")
+	fmt.Fprintf(&outer, "--%s\r\n", boundary)
+	outer.WriteString("Content-Type: application/pgp-encrypted\r\n")
+	outer.WriteString("Content-Description: PGP/MIME version identification\r\n\r\n")
+	outer.WriteString("Version: 1\r\n")
+	fmt.Fprintf(&outer, "\r\n--%s\r\n", boundary)
+	outer.WriteString("Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n")
+	outer.WriteString("Content-Description: OpenPGP encrypted message\r\n")
+	outer.WriteString("Content-Disposition: inline; filename=\"encrypted.asc\"\r\n\r\n")
+	outer.Write(crlf(encrypted.Bytes()))
+	fmt.Fprintf(&outer, "\r\n--%s--\r\n", boundary)
+	return outer.Bytes(), nil
+}
+
+// pgpRecipientKeys finds a key for every recipient address.
+func pgpRecipientKeys(keys openpgp.EntityList, to []string) ([]*openpgp.Entity, error) {
+	var found []*openpgp.Entity
+	for _, addr := range to {
+		var key *openpgp.Entity
+	search:
+		for _, e := range keys {
+			for _, id := range e.Identities {
+				if id.UserId != nil && strings.EqualFold(id.UserId.Email, addr) {
+					key = e
+					break search
+				}
+			}
+		}
+		if key == nil {
+			return nil, fmt.Errorf("pgp: no public key for %s", addr)
+		}
+		found = append(found, key)
+	}
+	return found, nil
+}
+
+func mimeBoundary() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// crlf converts bare LF line endings, as produced by the armor writer, to CRLF.
+func crlf(b []byte) []byte {
+	b = bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(b, []byte("\n"), []byte("\r\n"), -1)
+}
@@ -0,0 +1,165 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+var pgpTestConfig = &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+
+func newPGPEntity(t *testing.T, email string) *openpgp.Entity {
+	e, err := openpgp.NewEntity("Test", "", email, pgpTestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+const pgpTestMessage = "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: Secret\r\n" +
+	"Mime-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\nHello Bob.\r\n"
+
+// pgpParts parses the protected message, checking its content type, and
+// returns its parts raw, i.e. with their headers.
+func pgpParts(t *testing.T, out []byte, mediaType, protocol string) (*mail.Message, [][]byte) {
+	msg, err := mail.ReadMessage(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mt != mediaType || params["protocol"] != protocol {
+		t.Fatalf("Content-Type %q", msg.Header.Get("Content-Type"))
+	}
+	if msg.Header.Get("Subject") != "Secret" || msg.Header.Get("Mime-Version") != "1.0" {
+		t.Errorf("outer header %v", msg.Header)
+	}
+	body, _ := io.ReadAll(msg.Body)
+	delim := []byte("\r\n--" + params["boundary"])
+	chunks := bytes.Split(append([]byte("\r\n"), body...), delim)
+	if len(chunks) != 4 || !bytes.HasPrefix(chunks[3], []byte("--")) {
+		t.Fatalf("%d parts in %q", len(chunks)-2, body)
+	}
+	parts := [][]byte{bytes.TrimPrefix(chunks[1], []byte("\r\n")), bytes.TrimPrefix(chunks[2], []byte("\r\n"))}
+
+	// The structure must also be readable by a MIME parser.
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for i := 0; i < 2; i++ {
+		if _, err := mr.NextPart(); err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+	}
+	return msg, parts
+}
+
+func TestPGPProtectSign(t *testing.T) {
+	alice := newPGPEntity(t, "alice@example.com")
+	out, err := PGPProtect([]byte(pgpTestMessage), []string{"bob@example.com"}, &PGPOptions{Signer: alice})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, parts := pgpParts(t, out, "multipart/signed", "application/pgp-signature")
+	_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if params["micalg"] != "pgp-sha256" {
+		t.Errorf("micalg %q", params["micalg"])
+	}
+	signed := parts[0]
+	if !bytes.HasPrefix(signed, []byte("Content-Type: text/plain; charset=UTF-8\r\n\r\nHello Bob.")) {
+		t.Errorf("signed part %q", signed)
+	}
+	sigPart, err := mail.ReadMessage(bytes.NewReader(parts[1]))
+	if err != nil || !strings.HasPrefix(sigPart.Header.Get("Content-Type"), "application/pgp-signature") {
+		t.Fatalf("signature part %q: %v", parts[1], err)
+	}
+	if _, err = openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{alice}, bytes.NewReader(signed), sigPart.Body, nil); err != nil {
+		t.Errorf("signature: %v", err)
+	}
+
+	tampered := bytes.Replace(signed, []byte("Bob"), []byte("Eve"), 1)
+	sigPart, _ = mail.ReadMessage(bytes.NewReader(parts[1]))
+	if _, err = openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{alice}, bytes.NewReader(tampered), sigPart.Body, nil); err == nil {
+		t.Error("tampered part verified")
+	}
+}
+
+// pgpDecrypt checks the multipart/encrypted structure and decrypts it with
+// keyring.
+func pgpDecrypt(t *testing.T, out []byte, keyring openpgp.EntityList) (*openpgp.MessageDetails, []byte) {
+	_, parts := pgpParts(t, out, "multipart/encrypted", "application/pgp-encrypted")
+	control, err := mail.ReadMessage(bytes.NewReader(parts[0]))
+	if err != nil || control.Header.Get("Content-Type") != "application/pgp-encrypted" {
+		t.Fatalf("control part %q: %v", parts[0], err)
+	}
+	if b, _ := io.ReadAll(control.Body); strings.TrimSpace(string(b)) != "Version: 1" {
+		t.Errorf("control part body %q", b)
+	}
+	data, err := mail.ReadMessage(bytes.NewReader(parts[1]))
+	if err != nil || !strings.HasPrefix(data.Header.Get("Content-Type"), "application/octet-stream") {
+		t.Fatalf("data part %q: %v", parts[1], err)
+	}
+	block, err := armor.Decode(data.Body)
+	if err != nil || block.Type != "PGP MESSAGE" {
+		t.Fatalf("armor: %v", err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, []byte("Content-Type: text/plain; charset=UTF-8\r\n\r\nHello Bob.\r\n")) {
+		t.Errorf("decrypted %q", plain)
+	}
+	return md, plain
+}
+
+func TestPGPProtectEncrypt(t *testing.T) {
+	bob := newPGPEntity(t, "bob@example.com")
+	out, err := PGPProtect([]byte(pgpTestMessage), []string{"Bob@example.com"}, &PGPOptions{Encrypt: true, Keys: openpgp.EntityList{bob}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("Hello Bob")) {
+		t.Error("plaintext in output")
+	}
+	md, _ := pgpDecrypt(t, out, openpgp.EntityList{bob})
+	if !md.IsEncrypted || md.IsSigned {
+		t.Errorf("encrypted %v, signed %v", md.IsEncrypted, md.IsSigned)
+	}
+
+	_, err = PGPProtect([]byte(pgpTestMessage), []string{"carol@example.com"}, &PGPOptions{Encrypt: true, Keys: openpgp.EntityList{bob}})
+	if err == nil {
+		t.Error("encrypted for a recipient without a key")
+	}
+}
+
+func TestPGPProtectSignAndEncrypt(t *testing.T) {
+	alice, bob := newPGPEntity(t, "alice@example.com"), newPGPEntity(t, "bob@example.com")
+	out, err := PGPProtect([]byte(pgpTestMessage), []string{"bob@example.com"},
+		&PGPOptions{Encrypt: true, Keys: openpgp.EntityList{bob}, Signer: alice})
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, _ := pgpDecrypt(t, out, openpgp.EntityList{bob, alice})
+	if !md.IsEncrypted || !md.IsSigned || md.SignedBy == nil || md.SignedBy.PublicKey.KeyId != alice.PrimaryKey.KeyId {
+		t.Errorf("encrypted %v, signed %v by %v", md.IsEncrypted, md.IsSigned, md.SignedBy)
+	}
+	if md.SignatureError != nil {
+		t.Errorf("signature: %v", md.SignatureError)
+	}
+}
+
+func TestPGPOptionsInvalid(t *testing.T) {
+	if _, err := NewPGPTransport(PGPOptions{}); err == nil {
+		t.Error("neither signing nor encryption accepted")
+	}
+}
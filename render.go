@@ -0,0 +1,261 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"unicode"
+
+	parser "golang.org/x/net/html"
+	"gopkg.in/gomail.v2"
+)
+
+// RenderedEmail is the output of RenderEmail.
+type RenderedEmail struct {
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// EmailTemplate describes how an email is rendered.
+type EmailTemplate struct {
+	// Subject is a text/template source, executed with the same params.
+	Subject string
+	// HTML template files, the first one is executed.
+	HTML []string
+	// Text template files for the plain text part. If empty the text is
+	// derived from the HTML part.
+	Text []string
+	// Funcs are made available to all templates.
+	Funcs map[string]interface{}
+}
+
+var emailTemplateCache = struct {
+	sync.Mutex
+	html map[string]*htmltemplate.Template
+	text map[string]*texttemplate.Template
+}{
+	html: make(map[string]*htmltemplate.Template),
+	text: make(map[string]*texttemplate.Template),
+}
+
+// emailTemplateKey identifies a template set by all of its files.
+func emailTemplateKey(files []string) string {
+	return strings.Join(files, "\x00")
+}
+
+// RenderEmail renders subject and the html templates with params.
+func RenderEmail(subject string, templates []string, params map[string]interface{}) (*RenderedEmail, error) {
+	t := &EmailTemplate{Subject: subject, HTML: templates}
+	return t.Render(params)
+}
+
+// Render executes the templates with params.
+func (t *EmailTemplate) Render(params map[string]interface{}) (r *RenderedEmail, err error) {
+	if len(t.HTML) == 0 {
+		return nil, errors.New("email template has no html files")
+	}
+	r = &RenderedEmail{}
+
+	subject, err := texttemplate.New("subject").Funcs(t.Funcs).Parse(t.Subject)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = subject.Execute(&buf, params); err != nil {
+		return nil, err
+	}
+	r.Subject = strings.TrimSpace(buf.String())
+
+	html, err := t.htmlTemplate()
+	if err != nil {
+		return nil, err
+	}
+	buf.Reset()
+	if err = html.Execute(&buf, params); err != nil {
+		return nil, err
+	}
+	r.HTML = buf.String()
+
+	if len(t.Text) == 0 {
+		r.Text = htmlToText(r.HTML)
+		return
+	}
+
+	text, err := t.textTemplate()
+	if err != nil {
+		return nil, err
+	}
+	buf.Reset()
+	if err = text.Execute(&buf, params); err != nil {
+		return nil, err
+	}
+	r.Text = buf.String()
+	return
+}
+
+// Template sets with Funcs are not cached as functions cannot be compared.
+func (t *EmailTemplate) htmlTemplate() (tmpl *htmltemplate.Template, err error) {
+	key := emailTemplateKey(t.HTML)
+	if t.Funcs == nil {
+		emailTemplateCache.Lock()
+		tmpl = emailTemplateCache.html[key]
+		emailTemplateCache.Unlock()
+		if tmpl != nil {
+			return
+		}
+	}
+
+	tmpl, err = htmltemplate.New(filepath.Base(t.HTML[0])).Funcs(t.Funcs).ParseFiles(t.HTML...)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Funcs == nil {
+		emailTemplateCache.Lock()
+		emailTemplateCache.html[key] = tmpl
+		emailTemplateCache.Unlock()
+	}
+	return
+}
+
+func (t *EmailTemplate) textTemplate() (tmpl *texttemplate.Template, err error) {
+	key := emailTemplateKey(t.Text)
+	if t.Funcs == nil {
+		emailTemplateCache.Lock()
+		tmpl = emailTemplateCache.text[key]
+		emailTemplateCache.Unlock()
+		if tmpl != nil {
+			return
+		}
+	}
+
+	tmpl, err = texttemplate.New(filepath.Base(t.Text[0])).Funcs(t.Funcs).ParseFiles(t.Text...)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Funcs == nil {
+		emailTemplateCache.Lock()
+		emailTemplateCache.text[key] = tmpl
+		emailTemplateCache.Unlock()
+	}
+	return
+}
+
+// Message builds a multipart/alternative message with the text and html parts.
+func (r *RenderedEmail) Message(from string, to ...string) *gomail.Message {
+	m := gomail.NewMessage()
+	m.SetHeader("From", from)
+	m.SetHeader("To", to...)
+	m.SetHeader("Subject", r.Subject)
+	m.SetBody("text/plain", r.Text)
+	m.AddAlternative("text/html", r.HTML)
+	return m
+}
+
+// WritePreview writes the rendered email to dir as <name>.html and <name>.txt,
+// so it can be reviewed without sending it.
+func (r *RenderedEmail) WritePreview(dir, name string) error {
+	html := "<!-- Subject: " + htmltemplate.HTMLEscapeString(r.Subject) + " -->\n" + r.HTML
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".html"), []byte(html), 0644); err != nil {
+		return err
+	}
+	text := "Subject: " + r.Subject + "\n\n" + r.Text
+	return ioutil.WriteFile(filepath.Join(dir, name+".txt"), []byte(text), 0644)
+}
+
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+// Tags which start a new line in the text rendering of an html part.
+var textBlockTags = []string{"address", "blockquote", "br", "div", "dl", "dt", "dd", "h1", "h2", "h3", "h4", "h5", "h6", "hr", "li", "ol", "p", "pre", "table", "tr", "ul"}
+
+// htmlToText renders html as plain text: tags are dropped, block elements
+// become line breaks, entities are decoded and link targets are kept.
+func htmlToText(s string) string {
+	tokenizer := parser.NewTokenizer(strings.NewReader(s))
+	var b bytes.Buffer
+	ignore := ""
+	var href string
+
+	newline := func() {
+		if b.Len() > 0 && !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+			b.WriteString("\n")
+		}
+	}
+
+	for {
+		tokenType := tokenizer.Next()
+		token := tokenizer.Token()
+
+		switch tokenType {
+		case parser.ErrorToken:
+			if tokenizer.Err() != io.EOF {
+				return strings.TrimSpace(HTML(s))
+			}
+			lines := strings.Split(b.String(), "\n")
+			for i, l := range lines {
+				lines[i] = strings.TrimSpace(l)
+			}
+			return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+
+		case parser.StartTagToken, parser.SelfClosingTagToken:
+			if ignore != "" {
+				continue
+			}
+			switch {
+			case includes(ignoreTags, token.Data) && tokenType == parser.StartTagToken:
+				ignore = token.Data
+			case token.Data == "a":
+				href = ""
+				for _, a := range token.Attr {
+					if a.Key == "href" && strings.Contains(a.Val, "://") {
+						href = a.Val
+					}
+				}
+			case token.Data == "li":
+				newline()
+				b.WriteString("* ")
+			case includes(textBlockTags, token.Data):
+				newline()
+			}
+
+		case parser.EndTagToken:
+			switch {
+			case token.Data == ignore:
+				ignore = ""
+			case ignore != "":
+			case token.Data == "a" && href != "":
+				b.WriteString(" (" + href + ")")
+				href = ""
+			case token.Data == "p" || (len(token.Data) == 2 && token.Data[0] == 'h' && token.Data[1] >= '1' && token.Data[1] <= '6'):
+				newline()
+				b.WriteString("\n")
+			case includes(textBlockTags, token.Data):
+				newline()
+			}
+
+		case parser.TextToken:
+			if ignore == "" {
+				text := strings.Join(strings.Fields(token.Data), " ")
+				if text == "" {
+					continue
+				}
+				if unicode.IsSpace(rune(token.Data[0])) && b.Len() > 0 {
+					b.WriteString(" ")
+				}
+				b.WriteString(text)
+				if unicode.IsSpace(rune(token.Data[len(token.Data)-1])) {
+					b.WriteString(" ")
+				}
+			}
+		}
+	}
+}
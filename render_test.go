@@ -0,0 +1,55 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTemplates(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRenderEmailSetsSharingFirstFile(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"layout.html": `<p>{{template "content" .}}</p>`,
+		"a.html":      `{{define "content"}}A {{.name}}{{end}}`,
+		"b.html":      `{{define "content"}}B {{.name}}{{end}}`,
+	})
+	layout := filepath.Join(dir, "layout.html")
+	params := map[string]interface{}{"name": "x"}
+	for _, want := range []string{"A", "B", "A"} {
+		r, err := RenderEmail("Hi {{.name}}", []string{layout, filepath.Join(dir, strings.ToLower(want)+".html")}, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.HTML != "<p>"+want+" x</p>" || r.Subject != "Hi x" || strings.TrimSpace(r.Text) != want+" x" {
+			t.Errorf("got %+v, want %s", r, want)
+		}
+	}
+}
+
+func TestRenderEmailExecuteError(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"bad.html":  `<p>{{.n.Field}}</p>`,
+		"good.html": `<p>ok</p>`,
+		"bad.txt":   `{{.n.Field}}`,
+	})
+	params := map[string]interface{}{"n": 1}
+	for _, tmpl := range []*EmailTemplate{
+		{Subject: "s", HTML: []string{filepath.Join(dir, "bad.html")}},
+		{Subject: "{{.n.Field}}", HTML: []string{filepath.Join(dir, "good.html")}},
+		{Subject: "s", HTML: []string{filepath.Join(dir, "good.html")}, Text: []string{filepath.Join(dir, "bad.txt")}},
+	} {
+		if r, err := tmpl.Render(params); err == nil || !strings.Contains(err.Error(), "Field") {
+			t.Errorf("%+v: got %+v, %v", tmpl, r, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+)
+
+// A schema names a stored type and tracks its versions. Files stored with
+// WithSchema record the schema name and current version in their header;
+// loading an older version decodes it into the type registered for that
+// version and runs the migrations up to the current one:
+//
+//	RegisterSchema("settings", 1, func() interface{} { return &SettingsV1{} })
+//	RegisterSchema("settings", 2, func() interface{} { return &Settings{} })
+//	RegisterMigration("settings", 1, func(old interface{}) (interface{}, error) {
+//		v1 := old.(*SettingsV1)
+//		return &Settings{Name: v1.Title}, nil
+//	})
+//
+//	var s Settings
+//	err := LoadJson(&s, "settings.json", WithSchema("settings"), WithRewrite())
+//
+// Files without a header, such as those written before adopting a schema,
+// are taken to be of the lowest registered version.
+type schema struct {
+	types    map[int]func() interface{}
+	upgrades map[int]func(interface{}) (interface{}, error)
+	current  int
+	lowest   int
+}
+
+var (
+	schemasMu sync.RWMutex
+	schemas   = make(map[string]*schema)
+)
+
+func schemaNamed(name string) *schema {
+	s := schemas[name]
+	if s == nil {
+		s = &schema{
+			types:    make(map[int]func() interface{}),
+			upgrades: make(map[int]func(interface{}) (interface{}, error)),
+		}
+		schemas[name] = s
+	}
+	return s
+}
+
+// RegisterSchema registers the type of a version of the named schema. newValue
+// returns a pointer to a new value of it. The highest registered version is
+// the current one, which Store writes.
+func RegisterSchema(name string, version int, newValue func() interface{}) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	s := schemaNamed(name)
+	s.types[version] = newValue
+	if len(s.types) == 1 || version > s.current {
+		s.current = version
+	}
+	if len(s.types) == 1 || version < s.lowest {
+		s.lowest = version
+	}
+}
+
+// RegisterMigration registers the function converting a value of version
+// from of the named schema, as returned by its newValue, to version from+1.
+func RegisterMigration(name string, from int, upgrade func(old interface{}) (interface{}, error)) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	schemaNamed(name).upgrades[from] = upgrade
+}
+
+// WithSchema stores the named schema and its current version in the file
+// header, and upgrades older versions on load.
+func WithSchema(name string) FileOption {
+	return func(o *fileOptions) {
+		o.schema = name
+	}
+}
+
+// WithRewrite makes loading an upgraded file store it again in the current
+// version, keeping its compression and encryption.
+func WithRewrite() FileOption {
+	return func(o *fileOptions) {
+		o.rewrite = true
+	}
+}
+
+// currentSchemaVersion returns the version Store writes for the named schema.
+func currentSchemaVersion(name string) (int, error) {
+	schemasMu.RLock()
+	defer schemasMu.RUnlock()
+	s := schemas[name]
+	if s == nil || len(s.types) == 0 {
+		return 0, fmt.Errorf("%w: %q is not registered", ErrSchema, name)
+	}
+	return s.current, nil
+}
+
+// decodeVersion decodes a value of the given version with decode and
+// migrates it into data. It reports whether data was upgraded.
+func decodeVersion(name string, version int, decode func(interface{}) error, data interface{}) (bool, error) {
+	// Take what is needed while holding the lock, RegisterSchema and
+	// RegisterMigration may change the maps meanwhile.
+	schemasMu.RLock()
+	s := schemas[name]
+	if s == nil || len(s.types) == 0 {
+		schemasMu.RUnlock()
+		return false, fmt.Errorf("%w: %q is not registered", ErrSchema, name)
+	}
+	if version == 0 {
+		version = s.lowest
+	}
+	current := s.current
+	newValue := s.types[version]
+	var upgrades []func(interface{}) (interface{}, error)
+	for v := version; v < current; v++ {
+		upgrades = append(upgrades, s.upgrades[v])
+	}
+	schemasMu.RUnlock()
+
+	if version == current {
+		return false, decode(data)
+	}
+	if version > current {
+		return false, fmt.Errorf("%w: %q version %d is newer than %d", ErrSchema, name, version, current)
+	}
+
+	if newValue == nil {
+		return false, fmt.Errorf("%w: %q version %d is not registered", ErrSchema, name, version)
+	}
+	value := newValue()
+	if err := decode(value); err != nil {
+		return false, err
+	}
+	for i, upgrade := range upgrades {
+		v := version + i
+		if upgrade == nil {
+			return false, fmt.Errorf("%w: no migration of %q from version %d", ErrSchema, name, v)
+		}
+		var err error
+		if value, err = upgrade(value); err != nil {
+			return false, fmt.Errorf("%w: migrating %q from version %d: %v", ErrSchema, name, v, err)
+		}
+	}
+
+	dst, src := reflect.ValueOf(data), reflect.ValueOf(value)
+	if dst.Kind() != reflect.Ptr || src.Kind() != reflect.Ptr || dst.Type() != src.Type() {
+		return false, fmt.Errorf("%w: migration of %q returned %T, not %T", ErrSchema, name, value, data)
+	}
+	dst.Elem().Set(src.Elem())
+	return true, nil
+}
+
+// rewriteUpgraded stores data again in the codec, compression and encryption
+// of the original file, h being nil for plain files, and its file mode.
+func rewriteUpgraded(op string, c Codec, data interface{}, filename string, h *fileHeader, o *fileOptions) error {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return opError(op, filename, ErrWrite, err)
+	}
+	ro := *o
+	ro.codec = c.Name()
+	if h != nil {
+		ro.compression, ro.cipher = h.compression, h.cipher
+	} else {
+		ro.compression, ro.cipher = NoCompression, NoEncryption
+	}
+	return store(op, c, data, filename, fi.Mode().Perm(), &ro)
+}
@@ -0,0 +1,72 @@
+package util
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+var schemaTestRuns atomic.Int64
+
+// schemaTestName returns a schema name unique to this run of the test, as the
+// registry keeps what earlier runs registered.
+func schemaTestName(t *testing.T) string {
+	return fmt.Sprintf("%s-%d", t.Name(), schemaTestRuns.Add(1))
+}
+
+type settingsV1 struct{ Name string }
+
+type settingsV2 struct {
+	First, Last string
+}
+
+func TestLoadUpgradesSchema(t *testing.T) {
+	name := schemaTestName(t)
+	RegisterSchema(name, 1, func() interface{} { return new(settingsV1) })
+	filename := filepath.Join(t.TempDir(), "s.json")
+	if err := StoreJson(settingsV1{"John Doe"}, filename, 0600, WithSchema(name)); err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterSchema(name, 2, func() interface{} { return new(settingsV2) })
+	RegisterMigration(name, 1, func(old interface{}) (interface{}, error) {
+		var first, last string
+		fmt.Sscan(old.(*settingsV1).Name, &first, &last)
+		return &settingsV2{first, last}, nil
+	})
+	var s settingsV2
+	if err := LoadJson(&s, filename, WithSchema(name)); err != nil {
+		t.Fatal(err)
+	}
+	if s.First != "John" || s.Last != "Doe" {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestDecodeVersionConcurrentRegister(t *testing.T) {
+	name := schemaTestName(t)
+	RegisterSchema(name, 1, func() interface{} { return new(settingsV1) })
+	filename := filepath.Join(t.TempDir(), "s.json")
+	if err := StoreJson(settingsV1{"a"}, filename, 0600, WithSchema(name)); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for v := 100; v < 200; v++ {
+			RegisterMigration(name, v, func(old interface{}) (interface{}, error) { return old, nil })
+			RegisterSchema(name, -v, func() interface{} { return new(settingsV1) })
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		var s settingsV1
+		if err := LoadJson(&s, filename, WithSchema(name)); err != nil || s.Name != "a" {
+			t.Fatalf("got %+v, %v", s, err)
+		}
+	}
+	wg.Wait()
+}
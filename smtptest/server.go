@@ -0,0 +1,422 @@
+// Package smtptest provides an in-process SMTP server for end-to-end tests
+// of code sending email, in the spirit of net/http/httptest.
+//
+//	s, err := smtptest.NewServer()
+//	...
+//	defer s.Close()
+//	err = util.SendEmail(s.Addr(), "", "from@example.com", "Hi", "<p>body</p>", "to@example.com")
+//	msgs := s.Messages()
+package smtptest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a message accepted by the Server.
+type Message struct {
+	From string
+	To   []string
+	Data []byte
+	// TLS is set when the message was sent after STARTTLS.
+	TLS bool
+	// Username is the authenticated user, if any.
+	Username string
+}
+
+// Server is a minimal SMTP server listening on the loopback interface. It
+// supports STARTTLS with a generated certificate and AUTH PLAIN and LOGIN.
+type Server struct {
+	// Username and Password, when set before Start, are required from clients.
+	Username string
+	Password string
+	// RequireTLS rejects MAIL commands sent before STARTTLS.
+	RequireTLS bool
+
+	ln        net.Listener
+	tlsConfig *tls.Config
+	cert      *x509.Certificate
+
+	mu        sync.Mutex
+	messages  []Message
+	wg        sync.WaitGroup
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewServer starts a Server without authentication.
+func NewServer() (*Server, error) {
+	s := &Server{}
+	return s, s.Start()
+}
+
+// NewAuthServer starts a Server requiring the given credentials.
+func NewAuthServer(username, password string) (*Server, error) {
+	s := &Server{Username: username, Password: password}
+	return s, s.Start()
+}
+
+// Start generates the certificate and starts listening on a random port.
+func (s *Server) Start() (err error) {
+	s.tlsConfig, s.cert, err = generateTLSConfig()
+	if err != nil {
+		return
+	}
+	s.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	s.closed = make(chan struct{})
+
+	s.wg.Add(1)
+	go s.serve()
+	return
+}
+
+// Addr returns the "host:port" address of the server.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Port returns the port the server listens on.
+func (s *Server) Port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+// CertPool returns a pool with the server certificate, for clients which
+// verify it.
+func (s *Server) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.cert)
+	return pool
+}
+
+// Messages returns a copy of the accepted messages in arrival order.
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message{}, s.messages...)
+}
+
+// Reset drops all accepted messages.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	s.messages = nil
+	s.mu.Unlock()
+}
+
+// Close stops the server and waits for open sessions to end. Further calls
+// return the result of the first.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.closeErr = s.ln.Close()
+		s.wg.Wait()
+	})
+	return s.closeErr
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+type session struct {
+	s        *Server
+	conn     net.Conn
+	text     *textproto.Conn
+	tls      bool
+	username string
+	from     string
+	to       []string
+	mail     bool
+}
+
+func (s *Server) handle(conn net.Conn) {
+	ss := &session{s: s, conn: conn, text: textproto.NewConn(conn)}
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		ss.conn.Close()
+	}()
+
+	// Sessions end with the server.
+	go func() {
+		select {
+		case <-s.closed:
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	ss.reply(220, "localhost smtptest ESMTP ready")
+	for {
+		line, err := ss.text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		if !ss.command(strings.ToUpper(verb), arg) {
+			return
+		}
+	}
+}
+
+func (ss *session) reply(code int, lines ...string) {
+	for i, l := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		ss.text.PrintfLine("%d%s%s", code, sep, l)
+	}
+}
+
+// command handles one command and reports whether the session goes on.
+func (ss *session) command(verb, arg string) bool {
+	s := ss.s
+	switch verb {
+	case "HELO":
+		ss.reset()
+		ss.reply(250, "localhost")
+	case "EHLO":
+		ss.reset()
+		ext := []string{"localhost", "8BITMIME", "PIPELINING"}
+		if !ss.tls {
+			ext = append(ext, "STARTTLS")
+		}
+		if s.Username != "" {
+			ext = append(ext, "AUTH PLAIN LOGIN")
+		}
+		ss.reply(250, ext...)
+	case "STARTTLS":
+		if ss.tls {
+			ss.reply(503, "Already running TLS")
+			return true
+		}
+		ss.reply(220, "Ready to start TLS")
+		tlsConn := tls.Server(ss.conn, s.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return false
+		}
+		ss.conn, ss.text, ss.tls = tlsConn, textproto.NewConn(tlsConn), true
+		ss.reset()
+		ss.username = ""
+	case "AUTH":
+		ss.auth(arg)
+	case "MAIL":
+		switch {
+		case s.RequireTLS && !ss.tls:
+			ss.reply(530, "Must issue a STARTTLS command first")
+		case s.Username != "" && ss.username == "":
+			ss.reply(530, "Authentication required")
+		default:
+			addr, ok := pathArg(arg, "FROM:")
+			if !ok {
+				ss.reply(501, "Syntax: MAIL FROM:<address>")
+				return true
+			}
+			ss.reset()
+			ss.from, ss.mail = addr, true
+			ss.reply(250, "OK")
+		}
+	case "RCPT":
+		addr, ok := pathArg(arg, "TO:")
+		switch {
+		case !ss.mail:
+			ss.reply(503, "Need MAIL command")
+		case !ok || addr == "":
+			ss.reply(501, "Syntax: RCPT TO:<address>")
+		default:
+			ss.to = append(ss.to, addr)
+			ss.reply(250, "OK")
+		}
+	case "DATA":
+		if len(ss.to) == 0 {
+			ss.reply(503, "Need RCPT command")
+			return true
+		}
+		ss.reply(354, "End data with <CR><LF>.<CR><LF>")
+		data, err := ioutil.ReadAll(ss.text.DotReader())
+		if err != nil {
+			return false
+		}
+		s.mu.Lock()
+		s.messages = append(s.messages, Message{
+			From:     ss.from,
+			To:       ss.to,
+			Data:     bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1),
+			TLS:      ss.tls,
+			Username: ss.username,
+		})
+		s.mu.Unlock()
+		ss.reset()
+		ss.reply(250, "OK queued")
+	case "RSET":
+		ss.reset()
+		ss.reply(250, "OK")
+	case "NOOP":
+		ss.reply(250, "OK")
+	case "VRFY":
+		ss.reply(252, "Cannot VRFY user")
+	case "QUIT":
+		ss.reply(221, "Bye")
+		return false
+	default:
+		ss.reply(502, "Command not implemented")
+	}
+	return true
+}
+
+func (ss *session) reset() {
+	ss.from, ss.to, ss.mail = "", nil, false
+}
+
+func (ss *session) auth(arg string) {
+	s := ss.s
+	if s.Username == "" {
+		ss.reply(502, "AUTH not supported")
+		return
+	}
+	if ss.username != "" {
+		ss.reply(503, "Already authenticated")
+		return
+	}
+
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		ss.reply(501, "Syntax: AUTH mechanism")
+		return
+	}
+
+	var user, pass string
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		resp := ""
+		if len(fields) > 1 {
+			resp = fields[1]
+		} else {
+			resp = ss.challenge("")
+		}
+		b, err := base64.StdEncoding.DecodeString(resp)
+		parts := strings.Split(string(b), "\x00")
+		if err != nil || len(parts) != 3 {
+			ss.reply(501, "Malformed AUTH PLAIN response")
+			return
+		}
+		user, pass = parts[1], parts[2]
+	case "LOGIN":
+		u, err := base64.StdEncoding.DecodeString(ss.challenge("Username:"))
+		if err != nil {
+			ss.reply(501, "Malformed AUTH LOGIN response")
+			return
+		}
+		p, err := base64.StdEncoding.DecodeString(ss.challenge("Password:"))
+		if err != nil {
+			ss.reply(501, "Malformed AUTH LOGIN response")
+			return
+		}
+		user, pass = string(u), string(p)
+	default:
+		ss.reply(504, "Unrecognized authentication type")
+		return
+	}
+
+	if user != s.Username || pass != s.Password {
+		ss.reply(535, "Authentication credentials invalid")
+		return
+	}
+	ss.username = user
+	ss.reply(235, "Authentication successful")
+}
+
+// challenge sends a 334 continuation and returns the client response.
+func (ss *session) challenge(prompt string) string {
+	ss.reply(334, base64.StdEncoding.EncodeToString([]byte(prompt)))
+	line, _ := ss.text.ReadLine()
+	return strings.TrimSpace(line)
+}
+
+// pathArg extracts the address of "FROM:<addr> PARAMS".
+func pathArg(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if i := strings.Index(arg, " "); i >= 0 {
+		arg = arg[:i]
+	}
+	if !strings.HasPrefix(arg, "<") || !strings.HasSuffix(arg, ">") {
+		return "", false
+	}
+	return arg[1 : len(arg)-1], true
+}
+
+// generateTLSConfig creates a self-signed certificate for localhost.
+func generateTLSConfig() (*tls.Config, *x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"smtptest"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}},
+	}
+	return config, cert, nil
+}
+
+// String describes the server for test failure messages.
+func (s *Server) String() string {
+	return fmt.Sprintf("smtptest.Server(%s)", s.Addr())
+}
@@ -0,0 +1,98 @@
+package smtptest
+
+import (
+	"crypto/tls"
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+func TestServerAcceptsAuthenticatedTLSMail(t *testing.T) {
+	s, err := NewAuthServer("user", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := smtp.Dial(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.StartTLS(&tls.Config{RootCAs: s.CertPool(), ServerName: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Auth(smtp.PlainAuth("", "user", "secret", "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Mail("from@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"a@example.com", "b@example.org"} {
+		if err = c.Rcpt(rcpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Subject: Hi\r\n\r\nbody\r\n.dot\r\n"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	msgs := s.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages", len(msgs))
+	}
+	m := msgs[0]
+	if m.From != "from@example.com" || strings.Join(m.To, ",") != "a@example.com,b@example.org" {
+		t.Errorf("envelope %s -> %v", m.From, m.To)
+	}
+	if !m.TLS || m.Username != "user" {
+		t.Errorf("TLS=%v Username=%q", m.TLS, m.Username)
+	}
+	if !strings.HasSuffix(string(m.Data), "body\r\n.dot\r\n") {
+		t.Errorf("data %q", m.Data)
+	}
+
+	s.Reset()
+	if len(s.Messages()) != 0 {
+		t.Error("Reset kept messages")
+	}
+}
+
+func TestServerRejectsWrongPassword(t *testing.T) {
+	s, err := NewAuthServer("user", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := smtp.Dial(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.StartTLS(&tls.Config{RootCAs: s.CertPool(), ServerName: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Auth(smtp.PlainAuth("", "user", "wrong", "127.0.0.1")); err == nil {
+		t.Error("authenticated with a wrong password")
+	}
+}
+
+func TestServerCloseTwice(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// WriteJson encodes data as JSON to w.
+func WriteJson(data interface{}, w io.Writer) (err error) {
+	if err = json.NewEncoder(w).Encode(data); err != nil {
+		return opError("WriteJson", "", ErrEncode, err)
+	}
+	return
+}
+
+// ReadJson decodes the next JSON value from r into data. It may read past
+// the value into its buffer, so r cannot be used for further reads; use a
+// json.Decoder for a stream of values.
+func ReadJson(data interface{}, r io.Reader) (err error) {
+	if err = json.NewDecoder(r).Decode(data); err != nil {
+		return opError("ReadJson", "", ErrDecode, err)
+	}
+	return
+}
+
+// WriteGob encodes data as gob to w.
+func WriteGob(data interface{}, w io.Writer) (err error) {
+	if err = gob.NewEncoder(w).Encode(data); err != nil {
+		return opError("WriteGob", "", ErrEncode, err)
+	}
+	return
+}
+
+// ReadGob decodes a gob value from r into data.
+func ReadGob(data interface{}, r io.Reader) (err error) {
+	if err = gob.NewDecoder(r).Decode(data); err != nil {
+		return opError("ReadGob", "", ErrDecode, err)
+	}
+	return
+}
+
+// JsonLinesReader iterates over the records of newline-delimited JSON, one
+// line at a time. Blank lines are skipped.
+//
+//	r, err := OpenJsonLines("dump.jsonl")
+//	...
+//	defer r.Close()
+//	for r.Next() {
+//		var rec Record
+//		if err := r.Decode(&rec); err != nil {
+//			...
+//		}
+//	}
+//	if err := r.Err(); err != nil {
+//		...
+//	}
+type JsonLinesReader struct {
+	r      *bufio.Reader
+	closer io.Closer
+	name   string
+	line   []byte
+	lineNo int
+	err    error
+}
+
+// NewJsonLinesReader returns a reader of the records in r.
+func NewJsonLinesReader(r io.Reader) *JsonLinesReader {
+	return &JsonLinesReader{r: bufio.NewReader(r)}
+}
+
+// OpenJsonLines opens a newline-delimited JSON file for reading. The reader
+// must be closed.
+func OpenJsonLines(filename string) (*JsonLinesReader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, opError("OpenJsonLines", filename, ErrRead, err)
+	}
+	r := NewJsonLinesReader(f)
+	r.closer, r.name = f, filename
+	return r, nil
+}
+
+// Next advances to the next record and reports whether there is one.
+func (r *JsonLinesReader) Next() bool {
+	for r.err == nil {
+		line, err := r.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			r.err = opError("JsonLinesReader", r.name, ErrRead, err)
+			return false
+		}
+		if len(line) > 0 {
+			r.lineNo++
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			r.line = line
+			return true
+		}
+		if err == io.EOF {
+			r.err = io.EOF
+		}
+	}
+	r.line = nil
+	return false
+}
+
+// Bytes returns the current record. It is valid until the next call of Next.
+func (r *JsonLinesReader) Bytes() []byte {
+	return r.line
+}
+
+// Decode unmarshals the current record into v. The error includes the line
+// number.
+func (r *JsonLinesReader) Decode(v interface{}) error {
+	if err := json.Unmarshal(r.line, v); err != nil {
+		return opError("JsonLinesReader", r.name, ErrDecode, fmt.Errorf("line %d: %w", r.lineNo, err))
+	}
+	return nil
+}
+
+// Err returns the read error that stopped Next, nil at the end of input.
+func (r *JsonLinesReader) Err() error {
+	if r.err == io.EOF {
+		return nil
+	}
+	return r.err
+}
+
+// Close closes the file opened by OpenJsonLines.
+func (r *JsonLinesReader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// JsonLinesWriter appends records as newline-delimited JSON. Writes are
+// buffered; call Flush or Close.
+type JsonLinesWriter struct {
+	w    *bufio.Writer
+	file *os.File
+}
+
+// NewJsonLinesWriter returns a writer of records to w.
+func NewJsonLinesWriter(w io.Writer) *JsonLinesWriter {
+	return &JsonLinesWriter{w: bufio.NewWriter(w)}
+}
+
+// AppendJsonLines opens filename for appending records, creating it with
+// fileMode if needed. The writer must be closed.
+func AppendJsonLines(filename string, fileMode os.FileMode) (*JsonLinesWriter, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, fileMode)
+	if err != nil {
+		return nil, opError("AppendJsonLines", filename, ErrWrite, err)
+	}
+	w := NewJsonLinesWriter(f)
+	w.file = f
+	return w, nil
+}
+
+// Append writes data as one line. A value which cannot be encoded writes
+// nothing.
+func (w *JsonLinesWriter) Append(data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return opError("JsonLinesWriter", w.name(), ErrEncode, err)
+	}
+	w.w.Write(b)
+	if err = w.w.WriteByte('\n'); err != nil {
+		return opError("JsonLinesWriter", w.name(), ErrWrite, err)
+	}
+	return nil
+}
+
+// Flush writes buffered records to the underlying writer.
+func (w *JsonLinesWriter) Flush() error {
+	if err := w.w.Flush(); err != nil {
+		return opError("JsonLinesWriter", w.name(), ErrWrite, err)
+	}
+	return nil
+}
+
+// Close flushes the records and, for AppendJsonLines, syncs and closes the
+// file.
+func (w *JsonLinesWriter) Close() error {
+	err := w.Flush()
+	if w.file == nil {
+		return err
+	}
+	if er := w.file.Sync(); er != nil && err == nil {
+		err = opError("JsonLinesWriter", w.name(), ErrWrite, er)
+	}
+	if er := w.file.Close(); er != nil && err == nil {
+		err = opError("JsonLinesWriter", w.name(), ErrWrite, er)
+	}
+	return err
+}
+
+func (w *JsonLinesWriter) name() string {
+	if w.file == nil {
+		return ""
+	}
+	return w.file.Name()
+}
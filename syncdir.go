@@ -0,0 +1,421 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// SyncOp is the kind of a SyncChange.
+type SyncOp int
+
+const (
+	// SyncCreate is a file, directory or link new in the destination.
+	SyncCreate SyncOp = iota
+	// SyncUpdate is a changed file or link, or an entry replaced by one of
+	// another type.
+	SyncUpdate
+	// SyncDelete is an entry removed from the destination, with everything
+	// below it.
+	SyncDelete
+)
+
+func (op SyncOp) String() string {
+	switch op {
+	case SyncCreate:
+		return "create"
+	case SyncUpdate:
+		return "update"
+	case SyncDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("SyncOp(%d)", int(op))
+}
+
+// SyncChange is a change SyncDir made or, in a dry run, would make.
+type SyncChange struct {
+	Op SyncOp
+	// Path is relative to the directories synchronized and slash separated.
+	Path  string
+	IsDir bool
+	// Size is the number of bytes to copy.
+	Size int64
+}
+
+// SyncReport lists the changes of SyncDir in walk order.
+type SyncReport struct {
+	Changes []SyncChange
+	// Unchanged counts the files and links already up to date.
+	Unchanged int
+	// Bytes is the size of the files copied.
+	Bytes int64
+}
+
+// SyncOptions configures SyncDir. The zero value is usable.
+type SyncOptions struct {
+	// Checksum compares the contents of files of equal size by SHA-256
+	// instead of their modification time.
+	Checksum bool
+	// ModifyWindow is the difference up to which modification times count
+	// as equal, e.g. 2s for FAT file systems.
+	ModifyWindow time.Duration
+	// Delete removes entries of the destination missing in the source.
+	// Entries excluded by Filter are kept.
+	Delete bool
+	// DryRun reports the changes without making them.
+	DryRun bool
+	// Filter skips entries by their path relative to the directories.
+	Filter   *PathFilter
+	Symlinks SymlinkPolicy
+	// Preserve selects the metadata to keep besides the modification time,
+	// which is always kept since files are compared by it.
+	Preserve Preserve
+}
+
+// SyncDir makes the directory dst, which is created if missing, a mirror of
+// src, copying only files which differ in size or modification time, see
+// SyncOptions.Checksum. Files are written to a temporary name and renamed.
+// A failing entry does not stop the synchronization; all errors are
+// returned joined, along with the report of the changes done. Cancelling
+// ctx stops it and returns ctx.Err().
+func SyncDir(ctx context.Context, src, dst string, o *SyncOptions) (*SyncReport, error) {
+	if o == nil {
+		o = &SyncOptions{}
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, opError("SyncDir", src, ErrRead, err)
+	}
+	if !fi.IsDir() {
+		return nil, opError("SyncDir", src, ErrNotDirectory, nil)
+	}
+
+	s := &dirSyncer{ctx: ctx, o: o, report: &SyncReport{}}
+	s.syncDir(src, dst, "", fi, nil)
+	if err = ctx.Err(); err != nil {
+		return s.report, err
+	}
+	return s.report, errors.Join(s.errs...)
+}
+
+type dirSyncer struct {
+	ctx    context.Context
+	o      *SyncOptions
+	report *SyncReport
+	errs   []error
+}
+
+func (s *dirSyncer) fail(path string, kind, err error) {
+	s.errs = append(s.errs, opError("SyncDir", path, kind, err))
+}
+
+func (s *dirSyncer) change(op SyncOp, rel string, isDir bool, size int64) {
+	s.report.Changes = append(s.report.Changes, SyncChange{Op: op, Path: rel, IsDir: isDir, Size: size})
+}
+
+// syncDir synchronizes the directory src, with the info fi, to dst. rel is
+// their path below the roots, ancestors the directories above src.
+func (s *dirSyncer) syncDir(src, dst, rel string, fi os.FileInfo, ancestors []os.FileInfo) {
+	for _, a := range ancestors {
+		if os.SameFile(a, fi) {
+			s.fail(src, ErrRead, errors.New("symbolic link cycle"))
+			return
+		}
+	}
+	ancestors = append(ancestors, fi)
+
+	// Without the destination directory, which a dry run does not create,
+	// everything below is new.
+	op, exists := SyncCreate, true
+	if di, err := os.Lstat(dst); os.IsNotExist(err) {
+		exists = false
+	} else if err != nil {
+		s.fail(dst, ErrRead, err)
+		return
+	} else if !di.IsDir() {
+		if rel == "" {
+			s.fail(dst, ErrNotDirectory, nil)
+			return
+		}
+		op = SyncUpdate
+		if !s.remove(dst, rel, op, false) {
+			return
+		}
+		exists = false
+	}
+	if !exists {
+		if rel != "" {
+			s.change(op, rel, true, 0)
+		}
+		if !s.o.DryRun {
+			if err := os.MkdirAll(dst, 0777); err != nil {
+				s.fail(dst, ErrWrite, err)
+				return
+			}
+			exists = true
+		}
+	}
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		s.fail(src, ErrRead, err)
+		return
+	}
+	var dentries []os.DirEntry
+	existing := make(map[string]os.DirEntry)
+	if exists {
+		if dentries, err = os.ReadDir(dst); err != nil {
+			s.fail(dst, ErrRead, err)
+			return
+		}
+		for _, e := range dentries {
+			existing[e.Name()] = e
+		}
+	}
+
+	type entry struct {
+		name string
+		info os.FileInfo
+	}
+	var wanted []entry
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			s.fail(filepath.Join(src, e.Name()), ErrRead, err)
+			continue
+		}
+		if s.o.Filter != nil && s.o.Filter.match(path.Join(rel, e.Name()), info.IsDir()) {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if s.o.Symlinks == SymlinkSkip {
+				continue
+			}
+			if s.o.Symlinks == SymlinkFollow {
+				if info, err = os.Stat(filepath.Join(src, e.Name())); err != nil {
+					s.fail(filepath.Join(src, e.Name()), ErrRead, err)
+					continue
+				}
+			}
+		}
+		wanted = append(wanted, entry{e.Name(), info})
+	}
+
+	// Deleting first frees space for the copies.
+	if s.o.Delete && exists {
+		// Entries of the source which were skipped or unreadable count as
+		// present.
+		inSource := make(map[string]bool, len(entries))
+		for _, e := range entries {
+			inSource[e.Name()] = true
+		}
+		for _, e := range dentries {
+			r := path.Join(rel, e.Name())
+			if inSource[e.Name()] || s.o.Filter != nil && s.o.Filter.match(r, e.IsDir()) {
+				continue
+			}
+			if s.remove(filepath.Join(dst, e.Name()), r, SyncDelete, e.IsDir()) {
+				delete(existing, e.Name())
+			}
+		}
+	}
+
+	for _, e := range wanted {
+		if s.ctx.Err() != nil {
+			return
+		}
+		sp := filepath.Join(src, e.name)
+		dp := filepath.Join(dst, e.name)
+		r := path.Join(rel, e.name)
+		var cur os.FileInfo
+		if de, ok := existing[e.name]; ok {
+			if cur, err = de.Info(); err != nil {
+				s.fail(dp, ErrRead, err)
+				continue
+			}
+		}
+
+		switch mode := e.info.Mode(); {
+		case mode.IsDir():
+			s.syncDir(sp, dp, r, e.info, ancestors)
+		case mode.IsRegular():
+			s.syncFile(sp, dp, r, e.info, cur)
+		case mode&os.ModeSymlink != 0:
+			s.syncLink(sp, dp, r, cur)
+		default:
+			s.fail(sp, ErrRead, fmt.Errorf("cannot copy %v", mode.Type()))
+		}
+	}
+
+	if exists && !s.o.DryRun {
+		if err = preserveDirMetadata(dst, src, fi, s.o.Preserve|PreserveTimes); err != nil {
+			s.fail(dst, ErrWrite, err)
+		}
+	}
+}
+
+// remove deletes dst, reporting it if op is SyncDelete, and tells whether
+// it is gone.
+func (s *dirSyncer) remove(dst, rel string, op SyncOp, isDir bool) bool {
+	if op == SyncDelete {
+		s.change(op, rel, isDir, 0)
+	}
+	if s.o.DryRun {
+		return true
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		s.fail(dst, ErrWrite, err)
+		return false
+	}
+	return true
+}
+
+// syncFile copies the regular file src, with the info fi, to dst unless cur,
+// the info of dst if it exists, shows it up to date.
+func (s *dirSyncer) syncFile(src, dst, rel string, fi, cur os.FileInfo) {
+	op := SyncCreate
+	if cur != nil {
+		op = SyncUpdate
+		if cur.Mode().IsRegular() {
+			same, err := s.sameFile(src, dst, fi, cur)
+			if err != nil {
+				s.fail(dst, ErrRead, err)
+				return
+			}
+			if same {
+				s.report.Unchanged++
+				return
+			}
+		} else if !s.remove(dst, rel, op, cur.IsDir()) {
+			return
+		}
+	}
+	s.change(op, rel, false, fi.Size())
+	if s.o.DryRun {
+		return
+	}
+
+	n, err := s.copyFile(src, dst, fi)
+	if err != nil {
+		if s.ctx.Err() == nil {
+			s.fail(dst, ErrWrite, err)
+		}
+		return
+	}
+	s.report.Bytes += n
+}
+
+// copyFile copies src, with the info fi, to a new temporary file next to dst
+// and renames it to dst.
+func (s *dirSyncer) copyFile(src, dst string, fi os.FileInfo) (n int64, err error) {
+	sf, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer sf.Close()
+
+	df, err := createTempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".sync-", 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			df.Close()
+			os.Remove(df.Name())
+		}
+	}()
+	if n, err = copyOpenFile(s.ctx, df, sf, fi, s.o.Preserve|PreserveTimes); err != nil {
+		return
+	}
+	if err = df.Close(); err != nil {
+		return
+	}
+	return n, os.Rename(df.Name(), dst)
+}
+
+// createTempFile creates a new file in dir named prefix and a random suffix,
+// like os.CreateTemp, but with perm, less the umask, as its mode.
+func createTempFile(dir, prefix string, perm os.FileMode) (*os.File, error) {
+	for i := 0; ; i++ {
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		name := filepath.Join(dir, fmt.Sprintf("%s%x", prefix, b))
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) && i < 100 {
+			continue
+		}
+		return f, err
+	}
+}
+
+func (s *dirSyncer) sameFile(src, dst string, fi, cur os.FileInfo) (bool, error) {
+	if fi.Size() != cur.Size() {
+		return false, nil
+	}
+	if !s.o.Checksum {
+		d := fi.ModTime().Sub(cur.ModTime())
+		return d <= s.o.ModifyWindow && -d <= s.o.ModifyWindow, nil
+	}
+	a, err := fileSha256(src)
+	if err != nil {
+		return false, err
+	}
+	b, err := fileSha256(dst)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(a, b), nil
+}
+
+// syncLink recreates the link src at dst unless cur, the info of dst if it
+// exists, is a link to the same target.
+func (s *dirSyncer) syncLink(src, dst, rel string, cur os.FileInfo) {
+	target, err := os.Readlink(src)
+	if err != nil {
+		s.fail(src, ErrRead, err)
+		return
+	}
+	op := SyncCreate
+	if cur != nil {
+		op = SyncUpdate
+		if cur.Mode()&os.ModeSymlink != 0 {
+			if t, err := os.Readlink(dst); err == nil && t == target {
+				s.report.Unchanged++
+				return
+			}
+		}
+		if !s.remove(dst, rel, op, cur.IsDir()) {
+			return
+		}
+	}
+	s.change(op, rel, false, 0)
+	if s.o.DryRun {
+		return
+	}
+	if err = os.Symlink(target, dst); err != nil {
+		s.fail(dst, ErrWrite, err)
+	}
+}
+
+func fileSha256(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
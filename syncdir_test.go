@@ -0,0 +1,215 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func syncChanges(r *SyncReport) string {
+	s := make([]string, len(r.Changes))
+	for i, c := range r.Changes {
+		s[i] = c.Op.String() + " " + c.Path
+	}
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
+
+func TestSyncDir(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	makeTree(t, src, 2, 2)
+	ctx := context.Background()
+
+	r, err := SyncDir(ctx, src, dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := syncChanges(r); got != "create d0, create d0/f0, create d0/f1, create d1, create d1/f0, create d1/f1" {
+		t.Errorf("first sync: %s", got)
+	}
+
+	os.WriteFile(filepath.Join(src, "d0", "f0"), []byte("changed"), 0644)
+	os.Remove(filepath.Join(src, "d1", "f1"))
+	os.WriteFile(filepath.Join(dst, "extra"), nil, 0644)
+	o := &SyncOptions{Delete: true, DryRun: true}
+	if r, err = SyncDir(ctx, src, dst, o); err != nil {
+		t.Fatal(err)
+	}
+	want := "delete d1/f1, delete extra, update d0/f0"
+	if got := syncChanges(r); got != want {
+		t.Errorf("dry run: %s", got)
+	}
+	if _, err = os.Stat(filepath.Join(dst, "extra")); err != nil {
+		t.Error("dry run deleted")
+	}
+
+	o.DryRun = false
+	if r, err = SyncDir(ctx, src, dst, o); err != nil {
+		t.Fatal(err)
+	}
+	if got := syncChanges(r); got != want || r.Unchanged != 2 {
+		t.Errorf("sync: %s, %d unchanged", got, r.Unchanged)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dst, "d0", "f0")); string(b) != "changed" {
+		t.Errorf("got %q", b)
+	}
+	if r, err = SyncDir(ctx, src, dst, o); err != nil || len(r.Changes) != 0 {
+		t.Errorf("nothing to do: %s, %v", syncChanges(r), err)
+	}
+
+	t.Run("Checksum", func(t *testing.T) {
+		src, dst := filepath.Join(dir, "sum-src"), filepath.Join(dir, "sum-dst")
+		os.Mkdir(src, 0755)
+		os.WriteFile(filepath.Join(src, "f"), []byte("aaaa"), 0644)
+		if _, err := SyncDir(ctx, src, dst, nil); err != nil {
+			t.Fatal(err)
+		}
+		// Same size and time, other content.
+		fi, _ := os.Stat(filepath.Join(src, "f"))
+		os.WriteFile(filepath.Join(dst, "f"), []byte("bbbb"), 0644)
+		os.Chtimes(filepath.Join(dst, "f"), fi.ModTime(), fi.ModTime())
+
+		if r, err := SyncDir(ctx, src, dst, nil); err != nil || len(r.Changes) != 0 || r.Unchanged != 1 {
+			t.Errorf("by time: %s, %v", syncChanges(r), err)
+		}
+		r, err := SyncDir(ctx, src, dst, &SyncOptions{Checksum: true})
+		if got := syncChanges(r); err != nil || got != "update f" {
+			t.Errorf("by checksum: %s, %v", got, err)
+		}
+		if b, _ := os.ReadFile(filepath.Join(dst, "f")); string(b) != "aaaa" {
+			t.Errorf("got %q", b)
+		}
+		// Same content, other time.
+		os.Chtimes(filepath.Join(dst, "f"), fi.ModTime(), fi.ModTime().Add(-time.Hour))
+		if r, err := SyncDir(ctx, src, dst, &SyncOptions{Checksum: true}); err != nil || len(r.Changes) != 0 {
+			t.Errorf("same content: %s, %v", syncChanges(r), err)
+		}
+	})
+
+	t.Run("ModifyWindow", func(t *testing.T) {
+		src, dst := filepath.Join(dir, "window-src"), filepath.Join(dir, "window-dst")
+		os.Mkdir(src, 0755)
+		os.WriteFile(filepath.Join(src, "f"), []byte("a"), 0644)
+		if _, err := SyncDir(ctx, src, dst, nil); err != nil {
+			t.Fatal(err)
+		}
+		fi, _ := os.Stat(filepath.Join(src, "f"))
+		later := fi.ModTime().Add(time.Second)
+		os.Chtimes(filepath.Join(dst, "f"), later, later)
+
+		if r, err := SyncDir(ctx, src, dst, &SyncOptions{ModifyWindow: 2 * time.Second}); err != nil || len(r.Changes) != 0 {
+			t.Errorf("within the window: %s, %v", syncChanges(r), err)
+		}
+		if r, err := SyncDir(ctx, src, dst, nil); err != nil || syncChanges(r) != "update f" {
+			t.Errorf("without a window: %s, %v", syncChanges(r), err)
+		}
+	})
+
+	t.Run("FilterDelete", func(t *testing.T) {
+		src, dst := filepath.Join(dir, "filter-src"), filepath.Join(dir, "filter-dst")
+		os.Mkdir(src, 0755)
+		os.MkdirAll(filepath.Join(dst, "cache"), 0755)
+		for _, name := range []string{"src/a", "src/b.log", "dst/keep.log", "dst/cache/x", "dst/gone"} {
+			os.WriteFile(filepath.Join(dir, "filter-"+name), nil, 0644)
+		}
+		f, _ := NewPathFilter("*.log", "cache/")
+
+		r, err := SyncDir(ctx, src, dst, &SyncOptions{Delete: true, Filter: f})
+		if got := syncChanges(r); err != nil || got != "create a, delete gone" {
+			t.Errorf("got %s, %v", got, err)
+		}
+		for name, want := range map[string]bool{"a": true, "b.log": false, "keep.log": true, "cache/x": true, "gone": false} {
+			if _, err := os.Lstat(filepath.Join(dst, name)); (err == nil) != want {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("ReplaceTypes", func(t *testing.T) {
+		src, dst, outside := filepath.Join(dir, "types-src"), filepath.Join(dir, "types-dst"), filepath.Join(dir, "types-outside")
+		for _, d := range []string{"types-src/f2d", "types-src/l2d", "types-dst/d2f/sub", "types-dst/d2l", "types-outside"} {
+			os.MkdirAll(filepath.Join(dir, d), 0755)
+		}
+		for _, name := range []string{"src/f2d/x", "src/l2d/x", "src/d2f", "src/l2f", "dst/f2d", "dst/f2l", "dst/d2f/sub/x"} {
+			os.WriteFile(filepath.Join(dir, "types-"+name), []byte(name), 0644)
+		}
+		for _, l := range []string{"src/f2l", "src/d2l", "dst/l2f", "dst/l2d"} {
+			if err := os.Symlink(outside, filepath.Join(dir, "types-"+l)); err != nil {
+				t.Skip(err)
+			}
+		}
+
+		r, err := SyncDir(ctx, src, dst, &SyncOptions{Symlinks: SymlinkCopy})
+		want := "create f2d/x, create l2d/x, update d2f, update d2l, update f2d, update f2l, update l2d, update l2f"
+		if got := syncChanges(r); err != nil || got != want {
+			t.Errorf("got %s, %v", got, err)
+		}
+		for name, want := range map[string]os.FileMode{
+			"f2d": os.ModeDir, "l2d": os.ModeDir, "d2f": 0, "l2f": 0, "f2l": os.ModeSymlink, "d2l": os.ModeSymlink,
+		} {
+			if fi, err := os.Lstat(filepath.Join(dst, name)); err != nil || fi.Mode().Type() != want {
+				t.Errorf("%s is %v, %v", name, fi, err)
+			}
+		}
+		if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+			t.Errorf("wrote through a link: %d entries", len(entries))
+		}
+	})
+}
+
+func TestSyncDirTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	src, dst, outside := filepath.Join(dir, "src"), filepath.Join(dir, "dst"), filepath.Join(dir, "outside")
+	os.Mkdir(src, 0755)
+	os.Mkdir(dst, 0755)
+	os.WriteFile(filepath.Join(src, "x"), []byte("x"), 0644)
+	// Names a fixed temporary name for x would use.
+	os.WriteFile(filepath.Join(src, ".x.sync-tmp"), []byte("tmp"), 0644)
+	os.WriteFile(outside, []byte("keep"), 0644)
+	if err := os.Symlink(outside, filepath.Join(dst, ".x.sync-")); err != nil {
+		t.Skip(err)
+	}
+
+	if _, err := SyncDir(context.Background(), src, dst, &SyncOptions{Delete: true}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"x": "x", ".x.sync-tmp": "tmp"} {
+		if b, _ := os.ReadFile(filepath.Join(dst, name)); string(b) != want {
+			t.Errorf("%s = %q, want %q", name, b, want)
+		}
+	}
+	if b, _ := os.ReadFile(outside); string(b) != "keep" {
+		t.Errorf("wrote through the link: %q", b)
+	}
+	if entries, _ := os.ReadDir(dst); len(entries) != 2 {
+		t.Errorf("%d entries left", len(entries))
+	}
+}
+
+func TestSyncDirCancel(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	makeTree(t, src, 5, 20)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := SyncDir(ctx, src, filepath.Join(dir, "dst"), nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	r, err := SyncDir(ctx, src, filepath.Join(dir, "dst2"), nil)
+	if err == nil && len(r.Changes) == 105 {
+		t.Skip("finished before the timeout")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,363 @@
+package util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// Transport delivers a composed message to its recipients. It has the same
+// method set as gomail.Sender, so any Transport can be used with gomail.Send
+// and any gomail.SendFunc is a Transport.
+type Transport interface {
+	Send(from string, to []string, msg io.WriterTo) error
+}
+
+var (
+	emailMiddlewareMu sync.RWMutex
+	emailMiddleware   []*emailMiddlewareEntry
+)
+
+// emailMiddlewareEntry gives a registered wrapper an identity, as funcs
+// cannot be compared.
+type emailMiddlewareEntry struct {
+	wrap func(Transport) Transport
+}
+
+// UseEmailMiddleware registers transport wrappers, such as the one returned by
+// NewDKIMTransport, that SendMessage applies to every message. The first
+// registered wrapper sees the message first. The returned function
+// unregisters them again; calling it more than once is harmless.
+func UseEmailMiddleware(mw ...func(Transport) Transport) (remove func()) {
+	entries := make(map[*emailMiddlewareEntry]bool, len(mw))
+	emailMiddlewareMu.Lock()
+	for _, wrap := range mw {
+		e := &emailMiddlewareEntry{wrap: wrap}
+		entries[e] = true
+		emailMiddleware = append(emailMiddleware, e)
+	}
+	emailMiddlewareMu.Unlock()
+
+	return func() {
+		emailMiddlewareMu.Lock()
+		defer emailMiddlewareMu.Unlock()
+		kept := emailMiddleware[:0:0]
+		for _, e := range emailMiddleware {
+			if !entries[e] {
+				kept = append(kept, e)
+			}
+		}
+		emailMiddleware = kept
+	}
+}
+
+// SendMessage delivers m through t wrapped in the registered email middleware.
+// The envelope sender is taken from the Sender or From header, the recipients
+// from To, Cc and Bcc.
+func SendMessage(t Transport, m *gomail.Message) error {
+	from, to, err := messageEnvelope(m)
+	if err != nil {
+		return err
+	}
+
+	emailMiddlewareMu.RLock()
+	for i := len(emailMiddleware) - 1; i >= 0; i-- {
+		t = emailMiddleware[i].wrap(t)
+	}
+	emailMiddlewareMu.RUnlock()
+
+	return t.Send(from, to, m)
+}
+
+// messageEnvelope extracts the SMTP envelope from the message headers.
+func messageEnvelope(m *gomail.Message) (from string, to []string, err error) {
+	fromHeader := m.GetHeader("Sender")
+	if len(fromHeader) == 0 {
+		fromHeader = m.GetHeader("From")
+	}
+	if len(fromHeader) == 0 {
+		err = fmt.Errorf("%w: \"From\" header is absent", ErrInvalidMessage)
+		return
+	}
+	addr, err := mail.ParseAddress(fromHeader[0])
+	if err != nil {
+		err = fmt.Errorf("%w: invalid sender %q: %v", ErrInvalidMessage, fromHeader[0], err)
+		return
+	}
+	from = addr.Address
+
+	seen := make(map[string]bool)
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		for _, v := range m.GetHeader(field) {
+			addr, er := mail.ParseAddress(v)
+			if er != nil {
+				err = fmt.Errorf("%w: invalid recipient %q: %v", ErrInvalidMessage, v, er)
+				return
+			}
+			if !seen[addr.Address] {
+				seen[addr.Address] = true
+				to = append(to, addr.Address)
+			}
+		}
+	}
+	if len(to) == 0 {
+		err = fmt.Errorf("%w: no recipients", ErrInvalidMessage)
+	}
+	return
+}
+
+// SMTPTransport delivers messages through an SMTP server, opening a new
+// connection for every message.
+type SMTPTransport struct {
+	Dialer *gomail.Dialer
+}
+
+// NewSMTPTransport returns an SMTPTransport for a "host:port" server address.
+// Like SendEmail it does not verify the server certificate; replace
+// Dialer.TLSConfig to change that.
+func NewSMTPTransport(serverAddress, username, pass string) (*SMTPTransport, error) {
+	host, portStr, err := net.SplitHostPort(serverAddress)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := gomail.NewDialer(host, port, username, pass)
+	d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+
+	return &SMTPTransport{Dialer: d}, nil
+}
+
+// Send implements Transport.
+func (t *SMTPTransport) Send(from string, to []string, msg io.WriterTo) error {
+	s, err := t.Dialer.Dial()
+	if err != nil {
+		return err
+	}
+	if err = s.Send(from, to, msg); err != nil {
+		s.Close()
+		return err
+	}
+	return s.Close()
+}
+
+// DefaultSendmailPath is used by SendmailTransport when Path is empty.
+const DefaultSendmailPath = "/usr/sbin/sendmail"
+
+// SendmailTransport pipes messages to a local sendmail-compatible binary.
+type SendmailTransport struct {
+	// Path of the binary, DefaultSendmailPath if empty.
+	Path string
+	// Args are passed before the envelope arguments.
+	Args []string
+}
+
+// Send implements Transport.
+func (t *SendmailTransport) Send(from string, to []string, msg io.WriterTo) error {
+	path := t.Path
+	if path == "" {
+		path = DefaultSendmailPath
+	}
+
+	args := append([]string{}, t.Args...)
+	args = append(args, "-i", "-f", from, "--")
+	args = append(args, to...)
+
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = &buf
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %v: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// FileTransport writes every message as an .eml file into Dir. The envelope
+// is recorded in X-Envelope-From and X-Envelope-To headers. Files are named
+// by the time and a random suffix, so several transports and processes can
+// share Dir, and written atomically, see WriteFileAtomic.
+type FileTransport struct {
+	Dir string
+	// Mode of the created files, DefaultFileMode if zero.
+	Mode os.FileMode
+}
+
+// Send implements Transport.
+func (t *FileTransport) Send(from string, to []string, msg io.WriterTo) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "X-Envelope-From: %s\r\n", from)
+	fmt.Fprintf(&buf, "X-Envelope-To: %s\r\n", strings.Join(to, ", "))
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	mode := t.Mode
+	if mode == 0 {
+		mode = DefaultFileMode
+	}
+
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%x.eml", time.Now().Format(FileTimeFormat), suffix)
+
+	return WriteFileAtomic(filepath.Join(t.Dir, name), buf.Bytes(), mode)
+}
+
+// MemoryTransport keeps sent messages in memory, so tests can assert on them.
+// It is safe for concurrent use.
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []SentMessage
+}
+
+// SentMessage is a message captured by MemoryTransport.
+type SentMessage struct {
+	From string
+	To   []string
+	Raw  []byte
+}
+
+// Send implements Transport.
+func (t *MemoryTransport) Send(from string, to []string, msg io.WriterTo) error {
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.messages = append(t.messages, SentMessage{
+		From: from,
+		To:   append([]string{}, to...),
+		Raw:  buf.Bytes(),
+	})
+	t.mu.Unlock()
+	return nil
+}
+
+// Messages returns a copy of the captured messages in sending order.
+func (t *MemoryTransport) Messages() []SentMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]SentMessage{}, t.messages...)
+}
+
+// Reset drops all captured messages.
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	t.messages = nil
+	t.mu.Unlock()
+}
+
+// Header parses the header of the message.
+func (m SentMessage) Header() (mail.Header, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Raw))
+	if err != nil {
+		return nil, err
+	}
+	return msg.Header, nil
+}
+
+// MessagePart is a leaf MIME part of a message with its transfer encoding
+// already decoded.
+type MessagePart struct {
+	ContentType string
+	Header      textproto.MIMEHeader
+	Body        []byte
+}
+
+// Parts returns the leaf parts of the message in document order, descending
+// into nested multiparts.
+func (m SentMessage) Parts() ([]MessagePart, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Raw))
+	if err != nil {
+		return nil, err
+	}
+	return mimeParts(textproto.MIMEHeader(msg.Header), msg.Body)
+}
+
+// Part returns the first leaf part with the given media type, e.g. "text/html".
+func (m SentMessage) Part(mediaType string) (part MessagePart, ok bool) {
+	parts, err := m.Parts()
+	if err != nil {
+		return
+	}
+	for _, p := range parts {
+		if mt, _, _ := mime.ParseMediaType(p.ContentType); mt == mediaType {
+			return p, true
+		}
+	}
+	return
+}
+
+func mimeParts(h textproto.MIMEHeader, body io.Reader) (parts []MessagePart, err error) {
+	contentType := h.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, er := mr.NextRawPart()
+			if er == io.EOF {
+				return
+			}
+			if er != nil {
+				return nil, er
+			}
+			sub, er := mimeParts(p.Header, p)
+			if er != nil {
+				return nil, er
+			}
+			parts = append(parts, sub...)
+		}
+	}
+
+	var r io.Reader = body
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return []MessagePart{{ContentType: contentType, Header: h, Body: b}}, nil
+}
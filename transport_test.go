@@ -0,0 +1,98 @@
+package util
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSendEmailViaMemoryTransport(t *testing.T) {
+	var mt MemoryTransport
+	err := SendEmailVia(&mt, "a@example.com", "Hello", "<b>hi</b>", "b@example.com", "C <c@example.org>", "b@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := mt.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+	m := msgs[0]
+	if m.From != "a@example.com" {
+		t.Errorf("From = %q", m.From)
+	}
+	if want := []string{"b@example.com", "c@example.org"}; !reflect.DeepEqual(m.To, want) {
+		t.Errorf("To = %q, want %q", m.To, want)
+	}
+	h, err := m.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Get("Subject"); got != "Hello" {
+		t.Errorf("Subject = %q", got)
+	}
+	p, ok := m.Part("text/html")
+	if !ok || string(p.Body) != "<b>hi</b>" {
+		t.Errorf("html part = %q, %v", p.Body, ok)
+	}
+
+	mt.Reset()
+	if len(mt.Messages()) != 0 {
+		t.Error("Reset kept messages")
+	}
+}
+
+func TestSendMessageRejectsMissingRecipients(t *testing.T) {
+	var mt MemoryTransport
+	err := SendEmailVia(&mt, "a@example.com", "Hello", "hi")
+	if err == nil {
+		t.Fatal("want error")
+	}
+	if len(mt.Messages()) != 0 {
+		t.Error("message was sent")
+	}
+}
+
+func TestFileTransportSharedDir(t *testing.T) {
+	dir := t.TempDir()
+	a, b := &FileTransport{Dir: dir}, &FileTransport{Dir: dir}
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		for _, ft := range []*FileTransport{a, b} {
+			wg.Add(1)
+			go func(ft *FileTransport) {
+				defer wg.Done()
+				if err := SendEmailVia(ft, "a@example.com", "Hello", "hi", "b@example.com"); err != nil {
+					t.Error(err)
+				}
+			}(ft)
+		}
+	}
+	wg.Wait()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2*n {
+		t.Fatalf("got %d files, want %d", len(files), 2*n)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != len(files) {
+		t.Errorf("temporary files left: %d entries", len(entries))
+	}
+
+	raw, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(raw, []byte("X-Envelope-From: a@example.com\r\nX-Envelope-To: b@example.com\r\n")) {
+		t.Errorf("missing envelope headers: %q", strings.SplitN(string(raw), "\r\n", 3))
+	}
+}